@@ -2,7 +2,6 @@ package api
 
 import (
 	"bufio"
-	"context"
 	"fmt"
 	"os"
 	"strconv"
@@ -10,74 +9,88 @@ import (
 	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/chatclient"
+	"github.com/saitofun/chat/pkg/depends/gateway"
 	"github.com/saitofun/chat/pkg/depends/protoc"
-	"github.com/saitofun/chat/pkg/models"
 	"github.com/saitofun/qlib/encoding/qjson"
-	"github.com/saitofun/qlib/net/qsock"
 )
 
 var (
-	client      *qsock.Client
-	User        *models.User
-	LoginAt     *time.Time
-	mtx         = &sync.Mutex{}
-	ctx, cancel = context.WithCancel(context.Background())
+	client  *chatclient.Client
+	LoginAt *time.Time
+	mtx     = &sync.Mutex{}
 )
 
-func init() {
-	var err error
-	client, err = qsock.NewClient(
-		qsock.ClientOptionParser(protoc.Parser),
-		qsock.ClientOptionRemote(config.ClientAddr),
-		qsock.ClientOptionProtocol(qsock.ProtocolTCP),
-		qsock.ClientOptionNodeID(" client"),
-		// qsock.ClientOptionRoute(protoc.CmdEcho, func(ev *qsock.Event) {
-		// 	Output(ev.Payload())
-		// }),
-	)
+// Start 按已加载的配置连接服务端, 完成握手后开始处理输入
+func Start() error {
+	parser, err := protoc.NewCodecParser(config.ServerCodec, config.MaxFrameSize)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	options := []chatclient.ClientOptionSetter{
+		chatclient.ClientOptionParser(parser),
+		chatclient.ClientOptionOnMessage(onMessage),
+		chatclient.ClientOptionOnNotice(func(msg *protoc.Notice) { Output(msg) }),
+		chatclient.ClientOptionOnDirect(func(msg *protoc.Direct) { Output(msg) }),
+		chatclient.ClientOptionOnError(func(_ protoc.Seq, err error) { Output(err) }),
+		chatclient.ClientOptionReconnect(config.ReconnectBackoff, config.ReconnectMaxBackoff),
+		chatclient.ClientOptionOnReconnect(onReconnect),
+	}
+	remote := config.ClientAddr
+	if config.ClientTLS {
+		conf, err := gateway.ClientTLSConfig(
+			config.ClientTLSCAFile,
+			config.ClientTLSServerName,
+			config.ClientTLSCertFile,
+			config.ClientTLSKeyFile,
+		)
+		if err != nil {
+			return err
+		}
+		remote = config.ClientTLSAddr
+		options = append(options, chatclient.ClientOptionTLS(conf))
+	}
+	client, err = chatclient.Dial(remote, options...)
+	if err != nil {
+		return err
 	}
 	go receiving()
 	go handling()
+	return nil
 }
 
-func Logoff(reason ...interface{}) {
-	if client != nil && !client.IsClosed() {
-		client.Close(reason...)
+// Client 当前连接, 未连接返回nil
+func Client() *chatclient.Client { return client }
+
+func Logoff() {
+	if client != nil {
+		client.Close()
 	}
 }
 
 func Shutdown() {
-	cancel()
 	os.Exit(-1)
 }
 
+// receiving 等待客户端关闭, 启用重连时连接断开后自动恢复
 func receiving() {
 	defer Shutdown()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		msg, err := client.RecvMessage()
-		if err != nil {
-			if err == qsock.ENodeTimeout {
-				continue
-			}
-			Output("[ERROR]: " + err.Error())
-			Output(err.Error())
-			return
-		}
-		if msg != nil {
-			Output(msg)
-		}
+	<-client.Done()
+	if err := client.Err(); err != nil {
+		Output("[ERROR]: " + err.Error())
 	}
 }
 
+// onReconnect 输出重连进度
+func onReconnect(attempt int, err error) {
+	if err != nil {
+		Output(fmt.Sprintf("[重连失败] 第%d次: %v", attempt, err))
+		return
+	}
+	Output("[已重连]")
+}
+
 // HandleInput 用户输入处理
 func HandleInput() interface{} {
 	reader := bufio.NewReader(os.Stdin)
@@ -90,30 +103,17 @@ func HandleInput() interface{} {
 	}
 	line := string(bytes)
 	if line[0] != '/' {
-		from := ""
-		if User != nil {
-			from = User.Name
-		}
-		return handlePub(from, line)
+		return handlePub(line)
 	}
-	words := strings.Split(line[1:], " ")
-	cmd, arg := "", ""
-	if len(words) > 0 {
-		cmd = strings.TrimSpace(words[0])
-	}
-	if len(words) > 1 {
-		arg = strings.TrimSpace(words[1])
+	words := strings.Fields(line[1:])
+	if len(words) == 0 {
+		return "无效命令"
 	}
-	return HandleCommand(cmd, arg)
+	return HandleCommand(words[0], words[1:]...)
 }
 
-func handlePub(from, line string) interface{} {
-	err := client.SendMessage(protoc.NewEcho(
-		protoc.Seq(uuid.New().ID()),
-		from,
-		line,
-	))
-	if err != nil {
+func handlePub(line string) interface{} {
+	if err := client.Send(line); err != nil {
 		return err
 	}
 	return "> "
@@ -123,114 +123,148 @@ func handlePub(from, line string) interface{} {
 func HandleCommand(cmd string, arg ...string) interface{} {
 	switch cmd {
 	case "reg":
-		if len(arg) == 0 || arg[0] == "" {
-			return "请输入用户名"
+		if len(arg) < 2 {
+			return "请输入用户名及密码"
 		}
-		return handleRegister(arg[0])
+		return login(client.Register(arg[0], arg[1]))
 	case "login":
 		if len(arg) == 0 || arg[0] == "" {
-			return "请输入用户名"
+			return "请输入用户名及密码"
+		}
+		password := ""
+		if len(arg) > 1 {
+			password = arg[1]
 		}
-		return handleLogin(arg[0])
+		return login(client.Login(arg[0], password))
+	case "resume":
+		if len(arg) == 0 || arg[0] == "" {
+			return "请输入会话令牌"
+		}
+		return login(client.Resume(arg[0]))
+	case "logout":
+		all := len(arg) > 0 && arg[0] == "all"
+		if err := client.Logout(all); err != nil {
+			return err
+		}
+		LoginAt = nil
+		return "已注销"
+	case "passwd":
+		if len(arg) != 2 {
+			return "请输入旧密码及新密码"
+		}
+		return result("密码已修改", client.Passwd(arg[0], arg[1]))
+	case "msg":
+		if len(arg) < 2 {
+			return "请输入用户名及私信内容"
+		}
+		return result("已发送", client.Direct(arg[0], strings.Join(arg[1:], " ")))
+	case "inbox":
+		var offset int
+		if len(arg) > 0 {
+			var err error
+			if offset, err = strconv.Atoi(arg[0]); err != nil || offset < 0 {
+				return "序号非法"
+			}
+		}
+		return result(client.Inbox(offset))
 	case "rooms":
-		return handleRoomList()
+		var from, limit int
+		if len(arg) > 0 {
+			var err error
+			if from, err = strconv.Atoi(arg[0]); err != nil || from < 0 {
+				return "房间号非法"
+			}
+		}
+		if len(arg) > 1 {
+			if limit, _ = strconv.Atoi(arg[1]); limit <= 0 {
+				return "条数非法"
+			}
+		}
+		return result(client.ListRooms(from, limit))
 	case "room":
 		if len(arg) == 0 || arg[0] == "" {
-			return "请输入房间号"
+			return "请输入房间名或房间号"
 		}
-		if id, err := strconv.Atoi(arg[0]); err != nil {
-			return "房间号非法"
-		} else {
-			return handleEnterRoom(id)
+		return result(client.Join(arg[0]))
+	case "create":
+		if len(arg) == 0 || arg[0] == "" {
+			return "请输入房间名"
 		}
+		return result(client.CreateRoom(arg[0], strings.Join(arg[1:], " ")))
+	case "topic":
+		return result(client.Topic(strings.Join(arg, " ")))
 	case "stats":
 		if len(arg) == 0 || arg[0] == "" {
 			return "请输入用户名"
 		}
-		return handleUserInfo(arg[0])
+		return result(client.Stats(arg[0]))
 	case "popular":
-		if len(arg) == 0 || arg[0] == "" {
-			return "请输入房间号"
-		}
-		if id, err := strconv.Atoi(arg[0]); err != nil {
-			return "房间号非法"
-		} else {
-			return handlePopularWords(id)
+		return result(client.Popular(first(arg)))
+	case "history":
+		return handleHistory(arg...)
+	case "who":
+		if len(arg) > 1 {
+			return result(client.Who(arg[0], arg[1]))
 		}
+		return result(client.Who(first(arg), ""))
 	default:
 		return "无效命令"
 	}
 }
 
-func handleRegister(username string) interface{} {
-	rsp, err := client.Request(protoc.NewInstruct(
-		protoc.Seq(uuid.New().ID()),
-		protoc.GmCreateUser,
-		username,
-	))
-	if err != nil {
-		return err
+// handleHistory 历史消息: /history [房间名或房间号] [消息ID] [条数]
+func handleHistory(args ...string) interface{} {
+	var (
+		limit  int
+		before uint64
+		err    error
+	)
+	if len(args) > 1 {
+		if before, err = strconv.ParseUint(args[1], 10, 64); err != nil {
+			return "消息ID非法"
+		}
 	}
-	return rsp
-}
-
-func handleLogin(username string) interface{} {
-	rsp, err := client.Request(protoc.NewInstruct(
-		protoc.Seq(uuid.New().ID()),
-		protoc.GmLogin,
-		username,
-	))
-	if err != nil {
-		return err
+	if len(args) > 2 {
+		if limit, err = strconv.Atoi(args[2]); err != nil {
+			return "条数非法"
+		}
 	}
-	return rsp
+	return result(client.History(first(args), before, limit))
 }
 
-func handleRoomList() interface{} {
-	rsp, err := client.Request(protoc.NewInstruct(
-		protoc.Seq(uuid.New().ID()),
-		protoc.GmRoomList,
-	))
-	if err != nil {
-		return err
+// first 第一个参数, 省略时为空
+func first(args []string) string {
+	if len(args) == 0 {
+		return ""
 	}
-	return rsp
+	return args[0]
 }
 
-func handleEnterRoom(id int) interface{} {
-	rsp, err := client.Request(protoc.NewInstruct(
-		protoc.Seq(uuid.New().ID()),
-		protoc.GmEnterRoom,
-		strconv.Itoa(id),
-	))
+// login 登录成功时记录登录时间
+func login(v interface{}, err error) interface{} {
 	if err != nil {
 		return err
 	}
-	return rsp
+	now := time.Now()
+	LoginAt = &now
+	return v
 }
 
-func handleUserInfo(args ...string) interface{} {
-	rsp, err := client.Request(protoc.NewInstruct(
-		protoc.Seq(uuid.New().ID()),
-		protoc.GmStats,
-		args...,
-	))
+// result 指令结果, 失败时输出业务错误
+func result(v interface{}, err error) interface{} {
 	if err != nil {
 		return err
 	}
-	return rsp
+	return v
 }
 
-func handlePopularWords(id int) interface{} {
-	rsp, err := client.Request(protoc.NewInstruct(
-		protoc.Seq(uuid.New().ID()),
-		protoc.GmPopular,
-		strconv.Itoa(id),
-	))
-	if err != nil {
-		return err
+// onMessage 输出房间消息, 提及当前用户的消息高亮显示
+func onMessage(msg *protoc.Echo) {
+	if u := client.User(); u != nil && msg.Mentioned(u.Name) {
+		Output("\033[1;33m" + msg.String() + "\033[0m")
+		return
 	}
-	return rsp
+	Output(msg)
 }
 
 // handling handle user input
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
 	"github.com/saitofun/chat/cmd/client/api"
+	"github.com/saitofun/chat/cmd/config"
 )
 
 func main() {
+	if err := config.Load(config.ScopeClient, os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if config.PrintConfig {
+		_ = config.Print(os.Stdout, config.ScopeClient)
+		return
+	}
+	if err := api.Start(); err != nil {
+		fmt.Println("client start failed: ", err)
+		os.Exit(1)
+	}
 	wait()
 }
 
@@ -16,10 +33,10 @@ func wait() {
 	c := make(chan os.Signal, 1)
 	_ = <-c
 	fmt.Println("client exited")
-	if api.User != nil && api.LoginAt != nil {
-		fmt.Printf("\tusername: %s\n", api.User.Name)
+	if cli := api.Client(); cli != nil && cli.User() != nil && api.LoginAt != nil {
+		fmt.Printf("\tusername: %s\n", cli.User().Name)
 		fmt.Printf("\tlogin at: %s\n", api.LoginAt.String())
 	}
-	api.Logoff("user terminated")
+	api.Logoff()
 	api.Shutdown()
 }
@@ -2,20 +2,128 @@ package config
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var (
-	MaxRoomCache             = 50
+	MaxRoomCache             = 50             // MaxRoomCache 进入房间时补发的历史消息数
+	MaxRoomHistory           = 1000           // MaxRoomHistory 房间保留的历史消息数
+	RoomHistoryKeepDuration  = time.Hour * 24 // RoomHistoryKeepDuration 历史消息保留时长, 0不限
 	MaxRoomPopularWords      = 10
 	PopularWordsKeepDuration = time.Minute * 10
+	RoomQueueSize            = 128           // RoomQueueSize 每个连接待投递的房间消息队列长度
+	RoomQueuePolicy          = "drop-oldest" // RoomQueuePolicy 队列满时的处理策略: drop-oldest/drop-newest/disconnect
+	QuietRooms               = ""            // QuietRooms 不广播用户进出通知的房间号或房间名, 逗号分隔
+	RoomIDReuse              = false         // RoomIDReuse 新建房间取最小的未使用房间号, 否则在已使用的最大房间号上递增
 	Addr                     = "localhost"
 	Port                     = 10086
 
 	ServerAddr = fmt.Sprintf(":%d", Port)
-	ClientAddr = fmt.Sprintf("localhost:%d", Port)
+	ClientAddr = fmt.Sprintf("%s:%d", Addr, Port)
+
+	ServerCodec = "binary" // ServerCodec TCP服务及客户端使用的协议编码: binary/json
+
+	WebSocketAddr  = ":10087" // WebSocketAddr WebSocket网关监听地址, 为空则不启用
+	WebSocketPath  = "/chat"  // WebSocketPath WebSocket升级路径
+	WebSocketCodec = "binary" // WebSocketCodec WebSocket网关使用的协议编码: binary/json
+
+	TLSAddr         = "" // TLSAddr TLS监听地址, 为空则不启用
+	TLSCertFile     = "" // TLSCertFile 服务端证书(PEM)
+	TLSKeyFile      = "" // TLSKeyFile 服务端私钥(PEM)
+	TLSClientCAFile = "" // TLSClientCAFile 客户端证书CA(PEM), 不为空则要求双向TLS
+
+	ClientTLS           = false             // ClientTLS 客户端是否经TLS连接ClientTLSAddr
+	ClientTLSAddr       = "localhost:10443" // ClientTLSAddr 服务端TLS监听地址
+	ClientTLSCAFile     = ""                // ClientTLSCAFile 校验服务端证书的CA(PEM), 为空使用系统根证书
+	ClientTLSServerName = ""                // ClientTLSServerName 校验的服务端名称, 为空按连接地址
+	ClientTLSCertFile   = ""                // ClientTLSCertFile 客户端证书(PEM), 用于双向TLS
+	ClientTLSKeyFile    = ""                // ClientTLSKeyFile 客户端私钥(PEM)
+
+	ReconnectBackoff    = time.Second      // ReconnectBackoff 客户端首次重连间隔, 0不重连
+	ReconnectMaxBackoff = time.Second * 30 // ReconnectMaxBackoff 客户端最大重连间隔
 
 	RemoteProfanityWordsURL = "https://raw.githubusercontent.com/CloudcadeSF/google-profanity-words/main/data/list.txt"
 	LocalProfanityWordsPath = "config/profanity_words.txt"
 	ProfanityWordsMask      = rune('*')
+
+	MaxFrameSize = uint32(64 * 1024) // MaxFrameSize 单帧最大长度(不含消息头), 不小于MinFrameSize
+
+	HeartbeatInterval  = time.Second * 30 // HeartbeatInterval 服务端心跳间隔
+	HeartbeatMaxMissed = 3                // HeartbeatMaxMissed 连续未应答心跳次数上限, 超过则回收连接
+
+	PasswordCost     = 10               // PasswordCost 密码bcrypt哈希强度(4-31)
+	LoginMaxFailures = 5                // LoginMaxFailures 连续登录失败次数上限, 超过后锁定账号
+	LoginLockout     = time.Minute * 15 // LoginLockout 账号锁定时长
+	SessionTTL       = time.Hour * 24   // SessionTTL 登录会话有效期, 恢复会话时续期
+	MaxUserDevices   = 5                // MaxUserDevices 同一用户同时登录的连接数上限
+	MaxMailboxSize   = 100              // MaxMailboxSize 用户信箱保留的离线消息条数
+
+	StoreFile        = ""      // StoreFile 用户、房间及消息的持久化文件, 为空不持久化
+	StoreCompactSize = 4 << 20 // StoreCompactSize 持久化日志增长超过该字节数且达到上次压缩后的两倍时压缩, 0仅在启动时压缩
+
+	ShutdownTimeout = time.Second * 10 // ShutdownTimeout 优雅关闭的最长等待时间, 超时后强制退出
 )
+
+// MinFrameSize 单帧最小长度, 须容纳分页应答(如历史消息)中消息列表以外的部分
+const MinFrameSize = 1024
+
+// Settings 服务运行时使用的配置, 由服务选项传入各模块; 同一进程内的多个服务可使用不同的配置
+type Settings struct {
+	MaxRoomCache             int
+	MaxRoomHistory           int
+	RoomHistoryKeepDuration  time.Duration
+	MaxRoomPopularWords      int
+	PopularWordsKeepDuration time.Duration
+	RoomQueueSize            int
+	RoomQueuePolicy          string
+	QuietRooms               string
+	ProfanityWordsMask       rune
+	MaxFrameSize             uint32
+	PasswordCost             int
+	LoginMaxFailures         int
+	LoginLockout             time.Duration
+	SessionTTL               time.Duration
+	MaxUserDevices           int
+	MaxMailboxSize           int
+	StoreCompactSize         int
+}
+
+// Current 当前全局配置的快照, 此后修改全局配置不影响返回值
+func Current() *Settings {
+	return &Settings{
+		MaxRoomCache:             MaxRoomCache,
+		MaxRoomHistory:           MaxRoomHistory,
+		RoomHistoryKeepDuration:  RoomHistoryKeepDuration,
+		MaxRoomPopularWords:      MaxRoomPopularWords,
+		PopularWordsKeepDuration: PopularWordsKeepDuration,
+		RoomQueueSize:            RoomQueueSize,
+		RoomQueuePolicy:          RoomQueuePolicy,
+		QuietRooms:               QuietRooms,
+		ProfanityWordsMask:       ProfanityWordsMask,
+		MaxFrameSize:             MaxFrameSize,
+		PasswordCost:             PasswordCost,
+		LoginMaxFailures:         LoginMaxFailures,
+		LoginLockout:             LoginLockout,
+		SessionTTL:               SessionTTL,
+		MaxUserDevices:           MaxUserDevices,
+		MaxMailboxSize:           MaxMailboxSize,
+		StoreCompactSize:         StoreCompactSize,
+	}
+}
+
+// QuietRoom 房间号为id或房间名为name的房间是否在QuietRooms中, 房间名不区分大小写, name为空时只按房间号匹配
+func (s *Settings) QuietRoom(id int, name string) bool {
+	for _, v := range strings.Split(s.QuietRooms, ",") {
+		v = strings.TrimSpace(v)
+		if n, err := strconv.Atoi(v); err == nil {
+			if n == id {
+				return true
+			}
+		} else if name != "" && strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
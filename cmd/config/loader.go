@@ -0,0 +1,383 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Scope 配置项适用的程序
+type Scope uint8
+
+const (
+	ScopeServer Scope = 1 << iota
+	ScopeClient
+	ScopeAll = ScopeServer | ScopeClient
+)
+
+// setting 配置项. name同时作为配置文件键和命令行参数名, 环境变量为CHAT_前缀的大写下划线形式
+type setting struct {
+	name  string
+	scope Scope
+	ptr   interface{} // ptr 指向包级变量
+	usage string
+}
+
+var settings = []setting{
+	{"addr", ScopeClient, &Addr, "服务端主机名, 未设置client-addr时与port组成连接地址"},
+	{"port", ScopeAll, &Port, "服务端端口, 未设置server-addr/client-addr时用于生成地址"},
+	{"server-addr", ScopeServer, &ServerAddr, "TCP服务监听地址"},
+	{"client-addr", ScopeAll, &ClientAddr, "TCP服务连接地址, 服务端网关以此为上游"},
+	{"server-codec", ScopeAll, &ServerCodec, "TCP协议编码: binary/json"},
+	{"websocket-addr", ScopeServer, &WebSocketAddr, "WebSocket网关监听地址, 为空不启用"},
+	{"websocket-path", ScopeServer, &WebSocketPath, "WebSocket升级路径"},
+	{"websocket-codec", ScopeServer, &WebSocketCodec, "WebSocket协议编码: binary/json"},
+	{"tls-addr", ScopeServer, &TLSAddr, "TLS监听地址, 为空不启用"},
+	{"tls-cert", ScopeServer, &TLSCertFile, "服务端证书(PEM)"},
+	{"tls-key", ScopeServer, &TLSKeyFile, "服务端私钥(PEM)"},
+	{"tls-client-ca", ScopeServer, &TLSClientCAFile, "客户端证书CA(PEM), 设置后要求双向TLS"},
+	{"client-tls", ScopeClient, &ClientTLS, "客户端经TLS连接client-tls-addr"},
+	{"client-tls-addr", ScopeClient, &ClientTLSAddr, "服务端TLS监听地址"},
+	{"client-tls-ca", ScopeClient, &ClientTLSCAFile, "校验服务端证书的CA(PEM), 为空使用系统根证书"},
+	{"client-tls-server-name", ScopeClient, &ClientTLSServerName, "校验的服务端名称"},
+	{"client-tls-cert", ScopeClient, &ClientTLSCertFile, "客户端证书(PEM)"},
+	{"client-tls-key", ScopeClient, &ClientTLSKeyFile, "客户端私钥(PEM)"},
+	{"reconnect-backoff", ScopeClient, &ReconnectBackoff, "连接断开后首次重连间隔, 按指数增长, 0不重连"},
+	{"reconnect-max-backoff", ScopeClient, &ReconnectMaxBackoff, "最大重连间隔"},
+	{"max-room-cache", ScopeServer, &MaxRoomCache, "进入房间时补发的历史消息数"},
+	{"max-room-history", ScopeServer, &MaxRoomHistory, "房间保留的历史消息数"},
+	{"room-history-keep-duration", ScopeServer, &RoomHistoryKeepDuration, "房间历史消息保留时长, 0不限"},
+	{"room-queue-size", ScopeServer, &RoomQueueSize, "每个连接待投递的房间消息队列长度"},
+	{"room-queue-policy", ScopeServer, &RoomQueuePolicy, "房间消息队列满时的处理策略: drop-oldest/drop-newest/disconnect"},
+	{"room-id-reuse", ScopeServer, &RoomIDReuse, "新建房间取最小的未使用房间号, 否则在已使用的最大房间号上递增"},
+	{"quiet-rooms", ScopeServer, &QuietRooms, "不广播用户进出通知的房间号或房间名, 逗号分隔"},
+	{"max-room-popular-words", ScopeServer, &MaxRoomPopularWords, "热词查询返回的最大词数"},
+	{"popular-words-keep-duration", ScopeServer, &PopularWordsKeepDuration, "热词统计时间窗口"},
+	{"profanity-words-url", ScopeServer, &RemoteProfanityWordsURL, "敏感词词库下载地址, 为空不下载"},
+	{"profanity-words-path", ScopeServer, &LocalProfanityWordsPath, "敏感词词库本地路径"},
+	{"profanity-words-mask", ScopeServer, &ProfanityWordsMask, "敏感词掩码字符"},
+	{"max-frame-size", ScopeAll, &MaxFrameSize, "单帧最大长度(不含消息头)"},
+	{"heartbeat-interval", ScopeServer, &HeartbeatInterval, "服务端心跳间隔, 0不启用"},
+	{"heartbeat-max-missed", ScopeServer, &HeartbeatMaxMissed, "连续未应答心跳次数上限"},
+	{"password-cost", ScopeServer, &PasswordCost, "密码bcrypt哈希强度(4-31)"},
+	{"login-max-failures", ScopeServer, &LoginMaxFailures, "连续登录失败次数上限, 超过后锁定账号"},
+	{"login-lockout", ScopeServer, &LoginLockout, "账号锁定时长"},
+	{"session-ttl", ScopeServer, &SessionTTL, "登录会话有效期, 恢复会话时续期"},
+	{"max-user-devices", ScopeServer, &MaxUserDevices, "同一用户同时登录的连接数上限"},
+	{"max-mailbox-size", ScopeServer, &MaxMailboxSize, "用户信箱保留的离线消息条数"},
+	{"store-file", ScopeServer, &StoreFile, "用户、房间及消息的持久化文件, 为空不持久化"},
+	{"store-compact-size", ScopeServer, &StoreCompactSize, "持久化日志增长超过该字节数且达到上次压缩后的两倍时压缩, 0仅在启动时压缩"},
+	{"shutdown-timeout", ScopeServer, &ShutdownTimeout, "优雅关闭的最长等待时间"},
+}
+
+var (
+	File        = "" // File 配置文件路径, 格式由扩展名决定, 见Formats, 也可由CHAT_CONFIG指定
+	PrintConfig = false
+)
+
+// Formats 支持的配置文件扩展名, 不区分大小写
+var Formats = []string{".yaml", ".yml", ".json"}
+
+// ErrUnsupportedFormat 配置文件扩展名不在Formats中
+var ErrUnsupportedFormat = errors.New("unsupported config format")
+
+// EnvPrefix 环境变量前缀
+const EnvPrefix = "CHAT_"
+
+// Load 按 默认值 < 配置文件 < 环境变量 < 命令行参数 的优先级加载scope适用的配置并校验.
+// 未显式设置server-addr/client-addr时由port重新生成
+func Load(scope Scope, args []string) error {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.StringVar(&File, "config", File, "配置文件路径("+strings.Join(Formats, "/")+")")
+	fs.BoolVar(&PrintConfig, "print-config", PrintConfig, "打印生效的配置后退出")
+	for _, s := range settings {
+		if s.scope&scope != 0 {
+			fs.Var(&value{s.ptr}, s.name, s.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// cli 命令行显式设置的配置项, set 任一来源显式设置的配置项
+	cli, set := make(map[string]bool), make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { cli[f.Name], set[f.Name] = true, true })
+
+	if File == "" {
+		File = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if File != "" {
+		values, err := readFile(File)
+		if err != nil {
+			return err
+		}
+		for name, v := range values {
+			s := lookup(name)
+			if s == nil {
+				return fmt.Errorf("config file %s: unknown key %q", File, name)
+			}
+			if cli[s.name] || s.scope&scope == 0 {
+				continue
+			}
+			if err = (&value{s.ptr}).Set(v); err != nil {
+				return fmt.Errorf("config file %s: %s: %v", File, name, err)
+			}
+			set[s.name] = true
+		}
+	}
+
+	for _, s := range settings {
+		if s.scope&scope == 0 || cli[s.name] {
+			continue
+		}
+		env := EnvName(s.name)
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		if err := (&value{s.ptr}).Set(v); err != nil {
+			return fmt.Errorf("env %s: %v", env, err)
+		}
+		set[s.name] = true
+	}
+
+	if !set["server-addr"] {
+		ServerAddr = fmt.Sprintf(":%d", Port)
+	}
+	if !set["client-addr"] {
+		ClientAddr = fmt.Sprintf("%s:%d", Addr, Port)
+	}
+	return Validate(scope)
+}
+
+// EnvName 配置项对应的环境变量名, 如max-room-cache对应CHAT_MAX_ROOM_CACHE
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// lookup 查找配置项, 配置文件键不区分大小写, `_`与`-`等价
+func lookup(name string) *setting {
+	name = strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+	for i := range settings {
+		if settings[i].name == name {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+func readFile(path string) (map[string]string, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(dat, &values)
+	case ".json":
+		err = json.Unmarshal(dat, &values)
+	default:
+		return nil, fmt.Errorf("config file %s: %w %q, supported: %s",
+			path, ErrUnsupportedFormat, filepath.Ext(path), strings.Join(Formats, ", "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	ret := make(map[string]string, len(values))
+	for k, v := range values {
+		switch v := v.(type) {
+		case string:
+			ret[k] = v
+		case float64: // json数字
+			ret[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case int, bool:
+			ret[k] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("config file %s: %s: unsupported value %v", path, k, v)
+		}
+	}
+	return ret, nil
+}
+
+// Validate 校验scope适用的配置
+func Validate(scope Scope) error {
+	var errs []string
+
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	codec := func(c string) bool { return c == "binary" || c == "json" }
+	// quietRooms 逗号分隔的正整数房间号或房间名, 房间名由字母、数字、-或_组成
+	quietRooms := func(s string) bool {
+		if s == "" {
+			return true
+		}
+		for _, v := range strings.Split(s, ",") {
+			v = strings.TrimSpace(v)
+			if n, err := strconv.Atoi(v); err == nil {
+				if n <= 0 {
+					return false
+				}
+				continue
+			}
+			if v == "" || len(v) > 32 || strings.TrimFunc(v, func(c rune) bool {
+				return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_'
+			}) != "" {
+				return false
+			}
+		}
+		return true
+	}
+	queuePolicy := func(p string) bool { return p == "drop-oldest" || p == "drop-newest" || p == "disconnect" }
+
+	check(Port > 0 && Port < 65536, "port %d out of range", Port)
+	check(codec(ServerCodec), "server-codec %q must be binary or json", ServerCodec)
+	check(MaxFrameSize >= MinFrameSize, "max-frame-size %d must not be less than %d", MaxFrameSize, MinFrameSize)
+	if scope&ScopeServer != 0 {
+		check(ServerAddr != "", "server-addr is required")
+		check(WebSocketAddr == "" || strings.HasPrefix(WebSocketPath, "/"),
+			"websocket-path %q must start with /", WebSocketPath)
+		check(codec(WebSocketCodec), "websocket-codec %q must be binary or json", WebSocketCodec)
+		check(TLSAddr == "" || (TLSCertFile != "" && TLSKeyFile != ""),
+			"tls-cert and tls-key are required when tls-addr is set")
+		check(MaxRoomCache > 0, "max-room-cache must be positive")
+		check(MaxRoomHistory >= MaxRoomCache, "max-room-history must not be less than max-room-cache")
+		check(RoomHistoryKeepDuration >= 0, "room-history-keep-duration must not be negative")
+		check(RoomQueueSize > 0, "room-queue-size must be positive")
+		check(queuePolicy(RoomQueuePolicy),
+			"room-queue-policy %q must be drop-oldest, drop-newest or disconnect", RoomQueuePolicy)
+		check(quietRooms(QuietRooms), "quiet-rooms %q must be comma separated room ids or names", QuietRooms)
+		check(MaxRoomPopularWords > 0, "max-room-popular-words must be positive")
+		check(PopularWordsKeepDuration > 0, "popular-words-keep-duration must be positive")
+		check(HeartbeatInterval >= 0, "heartbeat-interval must not be negative")
+		check(HeartbeatInterval == 0 || HeartbeatMaxMissed > 0, "heartbeat-max-missed must be positive")
+		check(ShutdownTimeout > 0, "shutdown-timeout must be positive")
+		check(PasswordCost >= 4 && PasswordCost <= 31, "password-cost %d out of range", PasswordCost)
+		check(LoginMaxFailures > 0, "login-max-failures must be positive")
+		check(LoginLockout > 0, "login-lockout must be positive")
+		check(SessionTTL > 0, "session-ttl must be positive")
+		check(MaxUserDevices > 0, "max-user-devices must be positive")
+		check(MaxMailboxSize > 0, "max-mailbox-size must be positive")
+		check(StoreCompactSize >= 0, "store-compact-size must not be negative")
+	}
+	if scope&ScopeClient != 0 {
+		check(ClientAddr != "", "client-addr is required")
+		check(!ClientTLS || ClientTLSAddr != "", "client-tls-addr is required when client-tls is set")
+		check((ClientTLSCertFile == "") == (ClientTLSKeyFile == ""),
+			"client-tls-cert and client-tls-key must be set together")
+		check(ReconnectBackoff >= 0, "reconnect-backoff must not be negative")
+		check(ReconnectBackoff == 0 || ReconnectMaxBackoff >= ReconnectBackoff,
+			"reconnect-max-backoff must not be less than reconnect-backoff")
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Print 以YAML格式输出scope适用的生效配置, 可直接作为配置文件使用
+func Print(w io.Writer, scope Scope) error {
+	out := yaml.MapSlice{}
+	for _, s := range settings {
+		if s.scope&scope == 0 {
+			continue
+		}
+		var v interface{}
+		switch p := s.ptr.(type) {
+		case *time.Duration:
+			v = p.String()
+		case *rune:
+			v = string(*p)
+		default:
+			v = p
+		}
+		out = append(out, yaml.MapItem{Key: s.name, Value: v})
+	}
+	dat, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(dat)
+	return err
+}
+
+// value 将包级变量适配为flag.Value
+type value struct{ ptr interface{} }
+
+func (v *value) String() string {
+	switch p := v.ptr.(type) {
+	case *string:
+		return *p
+	case *int:
+		return strconv.Itoa(*p)
+	case *uint32:
+		return strconv.FormatUint(uint64(*p), 10)
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *time.Duration:
+		return p.String()
+	case *rune:
+		return string(*p)
+	default:
+		return ""
+	}
+}
+
+func (v *value) Set(s string) error {
+	switch p := v.ptr.(type) {
+	case *string:
+		*p = s
+	case *int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*p = i
+	case *uint32:
+		i, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return err
+		}
+		*p = uint32(i)
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*p = b
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*p = d
+	case *rune:
+		if utf8.RuneCountInString(s) != 1 {
+			return fmt.Errorf("%q must be a single character", s)
+		}
+		r, _ := utf8.DecodeRuneInString(s)
+		*p = r
+	default:
+		return fmt.Errorf("unsupported type %T", p)
+	}
+	return nil
+}
+
+// IsBoolFlag 布尔参数可省略取值
+func (v *value) IsBoolFlag() bool {
+	_, ok := v.ptr.(*bool)
+	return ok
+}
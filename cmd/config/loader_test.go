@@ -0,0 +1,93 @@
+package config_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/saitofun/chat/cmd/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	tt := require.New(t)
+
+	dir := t.TempDir()
+	yml := filepath.Join(dir, "chat.yaml")
+	tt.NoError(os.WriteFile(yml, []byte(`
+port: 20086
+max_room_cache: 20
+heartbeat-interval: 5s
+profanity-words-mask: "#"
+websocket-addr: ""
+`), 0600))
+
+	// 文件 < 环境变量 < 命令行
+	t.Setenv("CHAT_MAX_ROOM_CACHE", "30")
+	t.Setenv("CHAT_HEARTBEAT_INTERVAL", "7s")
+	tt.NoError(Load(ScopeServer, []string{"--config", yml, "--heartbeat-interval", "9s"}))
+
+	tt.Equal(20086, Port)
+	tt.Equal(":20086", ServerAddr)
+	tt.Equal("localhost:20086", ClientAddr)
+	tt.Equal(30, MaxRoomCache)
+	tt.Equal(9*time.Second, HeartbeatInterval)
+	tt.Equal('#', ProfanityWordsMask)
+	tt.Equal("", WebSocketAddr)
+
+	buf := bytes.NewBuffer(nil)
+	tt.NoError(Print(buf, ScopeServer))
+	tt.Contains(buf.String(), "server-addr: :20086\n")
+	tt.Contains(buf.String(), "heartbeat-interval: 9s\n")
+	tt.NotContains(buf.String(), "client-tls")
+
+	// 打印的配置可直接作为配置文件
+	out := filepath.Join(dir, "print.yml")
+	tt.NoError(os.WriteFile(out, buf.Bytes(), 0600))
+	tt.NoError(Load(ScopeServer, []string{"--config", out}))
+	tt.Equal(":20086", ServerAddr)
+
+	js := filepath.Join(dir, "chat.json")
+	tt.NoError(os.WriteFile(js, []byte(`{"port": 30086, "client-addr": "chat.local:1"}`), 0600))
+	tt.NoError(Load(ScopeClient, []string{"--config", js}))
+	tt.Equal("chat.local:1", ClientAddr)
+
+	// quiet-rooms可混用房间号和房间名
+	tt.NoError(Load(ScopeServer, []string{"--quiet-rooms", "1, Lobby,big_hall"}))
+	conf := Current()
+	tt.True(conf.QuietRoom(1, ""))
+	tt.True(conf.QuietRoom(7, "lobby"))
+	tt.True(conf.QuietRoom(8, "big_hall"))
+	tt.False(conf.QuietRoom(2, "hall"))
+
+	t.Run("Invalid", func(t *testing.T) {
+		tt := require.New(t)
+
+		tt.Error(Load(ScopeServer, []string{"--port", "70000"}))
+		tt.Error(Load(ScopeServer, []string{"--max-room-cache", "abc"}))
+		tt.Error(Load(ScopeServer, []string{"--server-codec", "xml"}))
+		tt.Error(Load(ScopeServer, []string{"--max-frame-size", "256"}))
+		tt.Error(Load(ScopeServer, []string{"--tls-addr", ":10443"}))
+		tt.Error(Load(ScopeServer, []string{"--profanity-words-mask", "**"}))
+		tt.Error(Load(ScopeServer, []string{"--quiet-rooms", "0"}))
+		tt.Error(Load(ScopeServer, []string{"--quiet-rooms", "lobby,,hall"}))
+		tt.Error(Load(ScopeServer, []string{"--quiet-rooms", "big hall"}))
+		tt.Error(Load(ScopeClient, []string{"--client-tls-cert", "a.pem"}))
+		// 仅服务端适用的参数
+		tt.Error(Load(ScopeClient, []string{"--max-room-cache", "1"}))
+
+		bad := filepath.Join(dir, "bad.yaml")
+		tt.NoError(os.WriteFile(bad, []byte("unknown-key: 1\n"), 0600))
+		tt.Error(Load(ScopeServer, []string{"--config", bad}))
+
+		// 不支持的格式返回明确的错误
+		toml := filepath.Join(dir, "chat.toml")
+		tt.NoError(os.WriteFile(toml, []byte("port = 1\n"), 0600))
+		err := Load(ScopeServer, []string{"--config", toml})
+		tt.True(errors.Is(err, ErrUnsupportedFormat), err)
+		tt.Contains(err.Error(), ".yaml, .yml, .json")
+	})
+}
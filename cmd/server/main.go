@@ -1,20 +1,128 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
-	_ "github.com/saitofun/chat/cmd/server/api"
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/chat"
+	"github.com/saitofun/chat/pkg/depends/gateway"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/modules/profanity_words"
+	"github.com/saitofun/chat/pkg/modules/store"
 )
 
 // wait wait exit signal
-func wait() {
+func wait(srv *chat.Server) {
 	c := make(chan os.Signal, 1)
-	_ = <-c
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+	fmt.Println("server shutting down: ", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	// 超时后Shutdown不再等待消息写出, 注销在线用户后返回; 等待其返回后才关闭存储, 避免关闭时仍有写入
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			fmt.Println("server shutdown: ", err)
+		}
+	case <-c:
+		// 强制退出不关闭存储, 日志最后一行不完整时下次打开忽略该行
+		fmt.Println("server shutdown: forced")
+		os.Exit(1)
+	}
 	fmt.Println("server exited")
-	// @todo server.Shutdown() not implemented
+}
+
+// options 由配置生成服务选项, conf为传给各模块的配置
+func options(conf *config.Settings) ([]chat.ServerOptionSetter, error) {
+	parser, err := protoc.NewCodecParser(config.ServerCodec, config.MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	opts := []chat.ServerOptionSetter{
+		chat.ServerOptionListenAddr(config.ServerAddr),
+		chat.ServerOptionParser(parser),
+		chat.ServerOptionHeartbeat(config.HeartbeatInterval, config.HeartbeatMaxMissed),
+		chat.ServerOptionRoomIDReuse(config.RoomIDReuse),
+		chat.ServerOptionSettings(conf),
+	}
+
+	dict, err := profanity_words.Load(config.RemoteProfanityWordsURL, config.LocalProfanityWordsPath)
+	if err != nil {
+		log.Printf("profanity words filtering disabled: %v", err)
+	} else {
+		opts = append(opts, chat.ServerOptionDictionary(dict))
+	}
+
+	if config.WebSocketAddr != "" {
+		codec, err := protoc.NewCodecParser(config.WebSocketCodec, config.MaxFrameSize)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, chat.ServerOptionWebSocket(config.WebSocketAddr, config.WebSocketPath, codec))
+	}
+
+	if config.TLSAddr != "" {
+		conf, err := gateway.ServerTLSConfig(config.TLSCertFile, config.TLSKeyFile, config.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, chat.ServerOptionTLS(config.TLSAddr, conf))
+	}
+	return opts, nil
 }
 
 func main() {
-	wait()
+	if err := config.Load(config.ScopeServer, os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if config.PrintConfig {
+		_ = config.Print(os.Stdout, config.ScopeServer)
+		return
+	}
+
+	if err := run(); err != nil {
+		fmt.Println("server start failed: ", err)
+		os.Exit(1)
+	}
+}
+
+// run 启动服务并等待退出信号, 退出后关闭持久化存储
+func run() error {
+	conf := config.Current()
+	opts, err := options(conf)
+	if err != nil {
+		return err
+	}
+	if config.StoreFile != "" {
+		st, err := store.Open(config.StoreFile, conf)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+		opts = append(opts, chat.ServerOptionStore(st))
+	}
+	srv, err := chat.NewServer(opts...)
+	if err != nil {
+		return err
+	}
+	if err = srv.Start(context.Background()); err != nil {
+		return err
+	}
+	wait(srv)
+	return nil
 }
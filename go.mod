@@ -4,8 +4,11 @@ go 1.18
 
 require (
 	github.com/google/uuid v1.3.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/saitofun/qlib v0.0.0-20220501151223-4dc1bb63d836
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -0,0 +1,342 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/saitofun/qlib/encoding/qjson"
+	"github.com/saitofun/qlib/net/qmsg"
+	"github.com/saitofun/qlib/net/qsock"
+)
+
+func (s *Server) OnEcho(ev *qsock.Event) {
+	msg := ev.Payload().(*protoc.Echo)
+	c := ev.Node()
+	user := s.users.GetByClientID(c.ID())
+	if user == nil {
+		s.Response(msg.Seq, errors.ErrUserNotLogin, c)
+		return
+	}
+	msg.SetFrom(user.Name)
+	if names := s.users.Mentions(msg.Body); len(names) > 0 {
+		msg.SetMentions(names)
+	}
+	room := user.Room()
+	if err := user.Pub(msg); err != nil {
+		s.Response(msg.Seq, err, c)
+		return
+	}
+	if len(msg.Mentions) > 0 {
+		body := models.MentionNotice(msg.From, room.Id, msg.Body)
+		for _, info := range s.users.Mention(msg, room.Id) {
+			_ = info.Node().SendMessage(s.notice(protoc.NoticeMention, body, info.Node()))
+		}
+	}
+}
+
+func (s *Server) OnGmCmd(ev *qsock.Event) {
+	var (
+		msg, c   = ev.Payload().(*protoc.Instruct), ev.Node()
+		ctrlUser = s.users
+		ctrlRoom = s.rooms
+		user     = ctrlUser.GetByClientID(c.ID())
+		seq      = msg.Seq
+	)
+
+	anonymous := msg.GmCmd == protoc.GmCreateUser || msg.GmCmd == protoc.GmLogin || msg.GmCmd == protoc.GmResume
+	if user == nil && !anonymous {
+		s.Response(seq, errors.ErrUserNotLogin, c)
+		return
+	}
+	switch msg.GmCmd {
+	case protoc.GmCreateUser:
+		name, password, err := protoc.ParseCredentialArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidArg, c)
+			return
+		}
+		info, err := ctrlUser.CreateUser(name, password, c)
+		if err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		info.SetCaps(s.caps(c))
+		s.Response(seq, ctrlUser.SessionProfile(info), c)
+		return
+	case protoc.GmLogin:
+		name, password, err := protoc.ParseCredentialArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidArg, c)
+			return
+		}
+		u, err := ctrlUser.UserLogin(name, password, c)
+		if err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		u.SetCaps(s.caps(c))
+		s.Response(seq, ctrlUser.SessionProfile(u), c)
+		s.deliverMailbox(u)
+		return
+	case protoc.GmResume:
+		u, replaced, err := ctrlUser.Resume(strings.TrimSpace(msg.Arg), c)
+		if err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		if replaced != nil {
+			s.Notify(protoc.NoticeSessionTaken, "会话已在其他连接上恢复", replaced)
+			replaced.Stop()
+		}
+		u.SetCaps(s.caps(c))
+		s.Response(seq, ctrlUser.SessionProfile(u), c)
+		s.deliverMailbox(u)
+		return
+	case protoc.GmLogout:
+		arg := strings.TrimSpace(msg.Arg)
+		if arg != "" && arg != "all" {
+			s.Response(seq, errors.ErrInvalidArg, c)
+			return
+		}
+		if err := ctrlUser.Logout(c.ID(), arg == "all"); err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		s.Response(seq, "已注销", c)
+		return
+	case protoc.GmRoomList:
+		from, limit, err := protoc.ParseRoomListArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidArg, c)
+			return
+		}
+		s.Response(seq, ctrlRoom.RoomList(from, limit), c)
+		return
+	case protoc.GmEnterRoom:
+		name, resume, err := protoc.ParseRoomArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidRoomID, c)
+			return
+		}
+		var room *models.Room
+		if name == protoc.RoomNew {
+			room, err = ctrlRoom.Create("", user.Name, "")
+		} else if room = ctrlRoom.Lookup(name); room == nil {
+			err = errors.ErrRoomIDNotExists
+		}
+		if err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		if err = user.EntryRoom(room, resume); err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		s.Response(seq, room, c)
+		return
+	case protoc.GmCreateRoom:
+		name, description, err := protoc.ParseCreateRoomArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidRoomName, c)
+			return
+		}
+		room, err := ctrlRoom.Create(name, user.Name, s.mask(description))
+		if err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		if err = user.EntryRoom(room, nil); err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		s.Response(seq, room, c)
+		return
+	case protoc.GmTopic:
+		room := user.Room()
+		if room == nil {
+			s.Response(seq, errors.ErrNotEnterRoom, c)
+			return
+		}
+		if topic := strings.TrimSpace(msg.Arg); topic != "" {
+			if err := ctrlRoom.SetTopic(room, s.mask(topic), user.Name); err != nil {
+				s.Response(seq, err, c)
+				return
+			}
+		}
+		s.Response(seq, room, c)
+		return
+	case protoc.GmStats:
+		p := ctrlUser.Profile(msg.Arg)
+		if p == nil {
+			s.Response(seq, errors.ErrUserNotExisted, c)
+			return
+		}
+		s.Response(seq, p, c)
+		return
+	case protoc.GmPopular:
+		room, err := s.lookup(user, msg.Arg)
+		if err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		s.Response(seq, room.PopularWords(), c)
+		return
+	case protoc.GmHistory:
+		name, before, limit, err := protoc.ParseHistoryArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidArg, c)
+			return
+		}
+		room, err := s.lookup(user, name)
+		if err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		s.Response(seq, room.History(before, limit), c)
+		return
+	case protoc.GmWho:
+		name, after, err := protoc.ParseWhoArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidArg, c)
+			return
+		}
+		room, err := s.lookup(user, name)
+		if err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		s.Response(seq, room.Members(after), c)
+		return
+	case protoc.GmDirect:
+		to, body, err := protoc.ParseDirectArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidArg, c)
+			return
+		}
+		dm := protoc.NewDirect(protoc.Seq(uuid.New().ID()), user.Name, to, s.mask(body), time.Now())
+		online, err := ctrlUser.Direct(c.ID(), dm)
+		if err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		if !online {
+			s.Response(seq, "对方不在线, 上线后送达", c)
+			return
+		}
+		s.Response(seq, "已发送", c)
+		return
+	case protoc.GmInbox:
+		offset, err := protoc.ParseInboxArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidArg, c)
+			return
+		}
+		s.Response(seq, ctrlUser.Inbox(user.Name, offset), c)
+		return
+	case protoc.GmPasswd:
+		old, password, err := protoc.ParsePasswdArg(msg.Arg)
+		if err != nil {
+			s.Response(seq, errors.ErrInvalidArg, c)
+			return
+		}
+		if err = ctrlUser.ChangePassword(c.ID(), old, password); err != nil {
+			s.Response(seq, err, c)
+			return
+		}
+		s.Response(seq, "密码已修改", c)
+		return
+	default:
+		s.Response(seq, errors.ErrUnknownGmCmd, c)
+		return
+	}
+}
+
+// lookup 按房间名或房间号查找指令参数指定的房间, 参数为空或0时为用户当前所在房间
+func (s *Server) lookup(user *models.UserInfo, room string) (*models.Room, error) {
+	if room = strings.TrimSpace(room); room == "" || room == "0" {
+		if r := user.Room(); r != nil {
+			return r, nil
+		}
+		return nil, errors.ErrNotEnterRoom
+	}
+	if r := s.rooms.Lookup(room); r != nil {
+		return r, nil
+	}
+	return nil, errors.ErrRoomIDNotExists
+}
+
+// mask 替换text中的脏词, 未设置词库时原样返回
+func (s *Server) mask(text string) string {
+	if s.dictionary == nil {
+		return text
+	}
+	return s.dictionary.MaskWordsBy(text, s.conf.ProfanityWordsMask)
+}
+
+// caps 连接协商的能力集
+func (s *Server) caps(c *qsock.Node) protoc.Capability {
+	if p := s.peers.Get(c); p != nil {
+		return p.Caps
+	}
+	return 0
+}
+
+// Response 应答指令处理结果, 协商了CapResponse的连接使用结构化应答, 否则以SYSTEM回显消息应答
+func (s *Server) Response(seq protoc.Seq, msg interface{}, c *qsock.Node) {
+	var rsp qmsg.Message
+
+	if s.caps(c).Has(protoc.CapResponse) {
+		rsp = models.NewResponse(seq, msg)
+	} else {
+		body := ""
+		if err, ok := msg.(error); ok {
+			body = "[SERVER] " + err.Error()
+		} else if s, ok := msg.(interface{ String() string }); ok {
+			body = s.String()
+		} else {
+			body = qjson.UnsafeMarshalString(msg)
+		}
+		rsp = protoc.NewEcho(seq, "SYSTEM", body)
+	}
+	if err := c.SendMessage(rsp); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// deliverMailbox 向刚登录的连接按顺序投递信箱中离线期间收到的消息, 私信以私信推送, 提及以通知推送
+func (s *Server) deliverMailbox(u *models.UserInfo) {
+	for _, mail := range s.users.Undelivered(u.Name) {
+		var err error
+		if mail.Kind == models.MailMention {
+			err = u.Node().SendMessage(s.notice(protoc.NoticeMention, mail.Notice(), u.Node()))
+		} else {
+			err = u.Direct(mail.Direct(protoc.Seq(uuid.New().ID())))
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+}
+
+// Notify 向连接推送通知, 协商了CapNotice的连接使用Notice帧, 否则以SYSTEM回显消息推送;
+// 同步写出, 保证随后断开连接前对端已收到
+func (s *Server) Notify(kind protoc.NoticeKind, body string, c *qsock.Node) {
+	if err := c.WriteMessage(s.notice(kind, body, c)); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// notice 按连接协商的能力集构造通知消息
+func (s *Server) notice(kind protoc.NoticeKind, body string, c *qsock.Node) qmsg.Message {
+	msg := protoc.NewNotice(protoc.Seq(uuid.New().ID()), kind, body)
+	if s.caps(c).Has(protoc.CapNotice) {
+		return msg
+	}
+	return msg.Echo()
+}
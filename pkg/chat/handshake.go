@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/qlib/net/qsock"
+)
+
+// peer 连接状态及握手协商结果
+type peer struct {
+	Node    *qsock.Node
+	Version uint32            // Version 协商的协议版本, 0表示尚未完成握手
+	Caps    protoc.Capability // Caps 协商的能力集
+	seen    time.Time         // seen 最后一次收到消息的时间
+}
+
+// Negotiated 是否已完成握手
+func (p *peer) Negotiated() bool { return p.Version != 0 }
+
+// peers 以连接为键
+type peers struct {
+	peers map[*qsock.Node]*peer
+	mtx   *sync.Mutex
+}
+
+func newPeers() *peers {
+	return &peers{
+		peers: make(map[*qsock.Node]*peer),
+		mtx:   &sync.Mutex{},
+	}
+}
+
+func (ps *peers) Add(n *qsock.Node) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	ps.peers[n] = &peer{Node: n, seen: time.Now()}
+}
+
+func (ps *peers) Get(n *qsock.Node) *peer {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	return ps.peers[n]
+}
+
+func (ps *peers) Negotiate(n *qsock.Node, version uint32, caps protoc.Capability) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	ps.peers[n] = &peer{Node: n, Version: version, Caps: caps, seen: time.Now()}
+}
+
+// Touch 刷新连接最后活跃时间
+func (ps *peers) Touch(n *qsock.Node) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	if p, ok := ps.peers[n]; ok {
+		p.seen = time.Now()
+	}
+}
+
+func (ps *peers) Remove(n *qsock.Node) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	delete(ps.peers, n)
+}
+
+// Range 遍历全部连接状态快照, f返回false时停止
+func (ps *peers) Range(f func(p peer) bool) {
+	ps.mtx.Lock()
+	list := make([]peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		list = append(list, *p)
+	}
+	ps.mtx.Unlock()
+
+	for _, p := range list {
+		if !f(p) {
+			return
+		}
+	}
+}
+
+// OnHello 协商协议版本和能力集, 不兼容的连接应答后断开
+func (s *Server) OnHello(ev *qsock.Event) {
+	msg, c := ev.Payload().(*protoc.Hello), ev.Node()
+
+	version, caps, err := protoc.Negotiate(msg, protoc.Version, protoc.Capabilities)
+	if err != nil {
+		_ = c.WriteMessage(protoc.NewWelcome(msg.Seq, protoc.Version, protoc.Capabilities, err.Error()))
+		c.Stop(err)
+		return
+	}
+	s.peers.Negotiate(c, version, caps)
+	_ = c.SendMessage(protoc.NewWelcome(msg.Seq, version, caps, ""))
+}
+
+// Negotiated 仅在连接完成握手后才将消息路由到h
+func (s *Server) Negotiated(h qsock.Handler) qsock.Handler {
+	return func(ev *qsock.Event) {
+		c := ev.Node()
+		if p := s.peers.Get(c); p == nil || !p.Negotiated() {
+			seq, _ := ev.Payload().ID().(protoc.Seq)
+			_ = c.WriteMessage(protoc.NewEcho(seq, "SYSTEM", "[SERVER] "+errors.ErrNotNegotiated.Error()))
+			c.Stop(errors.ErrNotNegotiated)
+			return
+		}
+		s.peers.Touch(c)
+		h(ev)
+	}
+}
+
+// OnProtocolError 本端检测到畸形帧时向对端应答协议错误, 随后断开连接
+func (s *Server) OnProtocolError(ev *qsock.Event) {
+	msg, c := ev.Payload().(*protoc.ProtocolError), ev.Node()
+	if msg.Local() {
+		_ = c.WriteMessage(protoc.NewProtocolError(msg.Seq, msg.Reason))
+	}
+	s.users.UserOffline(c.ID())
+	c.Stop(msg)
+}
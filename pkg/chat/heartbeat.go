@@ -0,0 +1,48 @@
+package chat
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/qlib/net/qsock"
+)
+
+func (s *Server) OnPing(ev *qsock.Event) {
+	_ = ev.Send(protoc.NewPong(ev.Payload().(*protoc.Ping)))
+}
+
+// OnPong 心跳应答, 最后活跃时间已在Negotiated中刷新
+func (s *Server) OnPong(_ *qsock.Event) {}
+
+// heartbeatLoop 定时向支持心跳的连接发送Ping, 并回收超时未活跃的连接;
+// 未完成握手及未协商CapHeartbeat的连接同样在超时后回收
+func (s *Server) heartbeatLoop(ctx context.Context) {
+	if s.heartbeat <= 0 {
+		return
+	}
+	timeout := s.heartbeat * time.Duration(s.maxMissed)
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.peers.Range(func(p peer) bool {
+			if time.Since(p.seen) > timeout {
+				s.users.UserOffline(p.Node.ID())
+				p.Node.Stop("heartbeat timeout")
+				s.peers.Remove(p.Node)
+				return true
+			}
+			if p.Caps.Has(protoc.CapHeartbeat) {
+				_ = p.Node.SendMessage(protoc.NewPing(protoc.Seq(uuid.New().ID())))
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/modules/profanity_words"
+	"github.com/saitofun/chat/pkg/modules/rooms"
+	"github.com/saitofun/chat/pkg/modules/store"
+	"github.com/saitofun/chat/pkg/modules/users"
+	"github.com/saitofun/qlib/net/qmsg"
+)
+
+const (
+	DefaultHeartbeatInterval  = time.Second * 30
+	DefaultHeartbeatMaxMissed = 3
+)
+
+type ServerOption struct {
+	listenAddr string         // listenAddr TCP监听地址, 如":10086", ":0"由系统分配端口
+	listener   net.Listener   // listener 由调用方创建的监听, 优先于listenAddr, 关闭服务时一并关闭
+	tlsAddr    string         // tlsAddr TLS监听地址, 为空不启用
+	tlsConfig  *tls.Config    // tlsConfig 服务端TLS配置
+	parser     qmsg.Parser    // parser 协议解析器, 默认protoc.Parser
+	users      *users.Manager // users 用户管理, 多个服务可共享
+	rooms      *rooms.Manager // rooms 房间管理, 多个服务可共享
+	dictionary *profanity_words.Filter
+	reuse      bool          // reuse 新建房间取最小的未使用房间号
+	store      store.Store   // store 持久化存储, 为nil不持久化
+	heartbeat  time.Duration // heartbeat 心跳间隔, 0不启用
+	maxMissed  int           // maxMissed 连续未应答心跳次数上限
+	wsAddr     string        // wsAddr WebSocket网关监听地址, 为空不启用
+	wsPath     string
+	wsParser   qmsg.Parser
+	conf       *config.Settings // conf 服务配置, 默认为创建服务时全局配置的快照
+}
+
+type ServerOptionSetter func(*ServerOption)
+
+func ServerOptionListenAddr(v string) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.listenAddr = v
+	}
+}
+
+func ServerOptionListener(v net.Listener) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.listener = v
+	}
+}
+
+func ServerOptionTLS(addr string, conf *tls.Config) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.tlsAddr, o.tlsConfig = addr, conf
+	}
+}
+
+func ServerOptionParser(v qmsg.Parser) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.parser = v
+	}
+}
+
+func ServerOptionUsers(v *users.Manager) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.users = v
+	}
+}
+
+// ServerOptionRooms 房间管理, 设置后ServerOptionDictionary不再生效
+func ServerOptionRooms(v *rooms.Manager) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.rooms = v
+	}
+}
+
+// ServerOptionDictionary 敏感词词库, 不设置则不过滤
+func ServerOptionDictionary(v *profanity_words.Filter) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.dictionary = v
+	}
+}
+
+// ServerOptionRoomIDReuse 新建房间取最小的未使用房间号, 包括已释放的临时房间, 默认在已使用的最大房间号上递增;
+// 设置ServerOptionRooms后不再生效
+func ServerOptionRoomIDReuse(v bool) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.reuse = v
+	}
+}
+
+// ServerOptionStore 持久化存储, 创建服务时恢复已保存的用户、房间及消息; 由调用方在服务关闭后关闭
+func ServerOptionStore(v store.Store) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.store = v
+	}
+}
+
+func ServerOptionHeartbeat(interval time.Duration, maxMissed int) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.heartbeat, o.maxMissed = interval, maxMissed
+	}
+}
+
+// ServerOptionWebSocket WebSocket网关, parser为WebSocket侧协议解析器
+func ServerOptionWebSocket(addr, path string, parser qmsg.Parser) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.wsAddr, o.wsPath, o.wsParser = addr, path, parser
+	}
+}
+
+// ServerOptionSettings 服务配置, 用于本服务创建的用户管理、房间管理及房间; 设置ServerOptionUsers或
+// ServerOptionRooms时, 传入的管理使用其创建时的配置. 默认为创建服务时config全局配置的快照
+func ServerOptionSettings(v *config.Settings) ServerOptionSetter {
+	return func(o *ServerOption) {
+		o.conf = v
+	}
+}
@@ -0,0 +1,251 @@
+package chat
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/depends/gateway"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/modules/rooms"
+	"github.com/saitofun/chat/pkg/modules/users"
+	"github.com/saitofun/qlib/net/qsock"
+)
+
+// Server 聊天服务, 持有各自的监听、用户及房间管理, 同一进程内可运行多个.
+// qsock.Server无法关闭监听, 也不能接管已建立的连接, 因此由Server自行监听,
+// 每个连接经本地隧道交给一个qsock.Client作为服务端连接处理; 各隧道共用一个回环监听, 以令牌认证本地连接
+type Server struct {
+	*ServerOption
+	peers    *peers
+	routes   *qsock.Routes
+	lns      []net.Listener
+	ws       *gateway.WebSocket
+	loopback *gateway.Loopback
+	draining int32
+	ownRooms bool // ownRooms 房间管理由本服务创建, 未与其他服务共享
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mtx      *sync.Mutex
+}
+
+func NewServer(options ...ServerOptionSetter) (*Server, error) {
+	srv := &Server{
+		ServerOption: &ServerOption{
+			parser:    protoc.Parser,
+			heartbeat: DefaultHeartbeatInterval,
+			maxMissed: DefaultHeartbeatMaxMissed,
+		},
+		peers:  newPeers(),
+		routes: qsock.NewRoutes(),
+		mtx:    &sync.Mutex{},
+	}
+	for _, opt := range options {
+		opt(srv.ServerOption)
+	}
+	if srv.conf == nil {
+		srv.conf = config.Current()
+	}
+	if srv.listenAddr == "" && srv.listener == nil {
+		return nil, ErrInvalidListenAddr
+	}
+	if srv.tlsAddr != "" && srv.tlsConfig == nil {
+		return nil, ErrInvalidTLSConfig
+	}
+	if srv.users == nil {
+		srv.users = users.New(srv.conf)
+	}
+	if srv.rooms == nil {
+		srv.rooms = rooms.New(srv.dictionary, srv.reuse, srv.conf)
+		srv.ownRooms = true
+	}
+	if srv.store != nil {
+		d, err := srv.store.Load()
+		if err != nil {
+			return nil, err
+		}
+		srv.users.Restore(srv.store, d)
+		srv.rooms.Restore(srv.store, d)
+	}
+
+	srv.routes.Register(protoc.CmdHello, srv.OnHello)
+	srv.routes.Register(protoc.CmdProtocolError, srv.OnProtocolError)
+	srv.routes.Register(protoc.CmdEcho, srv.Negotiated(srv.OnEcho))
+	srv.routes.Register(protoc.CmdInstruct, srv.Negotiated(srv.OnGmCmd))
+	srv.routes.Register(protoc.CmdPing, srv.Negotiated(srv.OnPing))
+	srv.routes.Register(protoc.CmdPong, srv.Negotiated(srv.OnPong))
+	return srv, nil
+}
+
+// Start 开始监听并处理连接, 监听成功后返回; ctx结束时立即关闭服务, 不等待消息写出.
+// Shutdown后可再次Start; 调用方提供的监听已在Shutdown时关闭, 再次启动时改为监听listenAddr
+func (s *Server) Start(ctx context.Context) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.ctx != nil {
+		return ErrServerStarted
+	}
+	ln := s.listener
+	if ln == nil && s.listenAddr == "" {
+		return ErrInvalidListenAddr
+	}
+
+	lb, err := gateway.NewLoopback()
+	if err != nil {
+		return err
+	}
+	if ln == nil {
+		if ln, err = net.Listen("tcp", s.listenAddr); err != nil {
+			_ = lb.Close()
+			return err
+		}
+	}
+	lns := []net.Listener{ln}
+	if s.tlsAddr != "" {
+		tln, err := tls.Listen("tcp", s.tlsAddr, s.tlsConfig)
+		if err != nil {
+			// 已持有s.mtx, 不能调用s.close()
+			_ = ln.Close()
+			_ = lb.Close()
+			return err
+		}
+		lns = append(lns, tln)
+	}
+	sctx, cancel := context.WithCancel(context.Background())
+	s.ctx, s.cancel, s.loopback, s.lns = sctx, cancel, lb, lns
+	if s.ownRooms {
+		s.rooms.Mute(false)
+	}
+	for _, l := range s.lns {
+		go s.accept(l, lb)
+		fmt.Println("Chat server started: ", l.Addr())
+	}
+
+	if s.wsAddr != "" {
+		s.ws = gateway.NewWebSocket(s.wsAddr, s.wsPath, s.wsParser, ln.Addr().String(), s.parser)
+		go func(ws *gateway.WebSocket) {
+			if err := ws.ListenAndServe(); err != nil {
+				fmt.Println("WebSocket gateway stopped: ", err)
+			}
+		}(s.ws)
+		fmt.Println("WebSocket gateway started: ", s.wsAddr+s.wsPath)
+	}
+
+	go s.heartbeatLoop(sctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Shutdown(ctx)
+		case <-sctx.Done():
+		}
+	}()
+	return nil
+}
+
+// Addr TCP监听地址, 未启动时返回nil
+func (s *Server) Addr() net.Addr {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.lns) == 0 {
+		return nil
+	}
+	return s.lns[0].Addr()
+}
+
+// TLSAddr TLS监听地址, 未启用时返回nil
+func (s *Server) TLSAddr() net.Addr {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.lns) < 2 {
+		return nil
+	}
+	return s.lns[1].Addr()
+}
+
+func (s *Server) Users() *users.Manager { return s.users }
+
+func (s *Server) Rooms() *rooms.Manager { return s.rooms }
+
+// close 关闭监听及网关
+func (s *Server) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, ln := range s.lns {
+		_ = ln.Close()
+	}
+	if s.loopback != nil {
+		_ = s.loopback.Close()
+	}
+	if s.ws != nil {
+		_ = s.ws.Close()
+	}
+}
+
+func (s *Server) accept(ln net.Listener, lb *gateway.Loopback) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("listener: %v\n", err)
+			}
+			return
+		}
+		go s.serve(conn, lb)
+	}
+}
+
+// serve 处理一个连接, 同一连接的消息按序处理
+func (s *Server) serve(conn net.Conn, lb *gateway.Loopback) {
+	if s.Draining() {
+		_ = conn.Close()
+		return
+	}
+	tun, err := lb.Open(conn)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	cli, err := tun.Client(
+		qsock.ClientOptionParser(s.parser),
+		qsock.ClientOptionNodeID(conn.RemoteAddr().String()),
+	)
+	if err != nil {
+		_ = tun.Close()
+		return
+	}
+	n := cli.Endpoint()
+	s.peers.Add(n)
+	defer func() {
+		s.users.UserOffline(n.ID())
+		s.peers.Remove(n)
+		n.Stop()
+	}()
+
+	for {
+		msg, err := cli.RecvMessage()
+		if err != nil {
+			if qsock.IsTimeoutError(err) {
+				continue
+			}
+			return
+		}
+		if msg == nil {
+			return
+		}
+		ev := qsock.NewEvent(n, msg)
+		for _, h := range s.routes.Handlers(msg.Type()) {
+			h(ev)
+		}
+	}
+}
+
+var (
+	ErrInvalidListenAddr = errors.New("CHAT:invalid listen addr")
+	ErrInvalidTLSConfig  = errors.New("CHAT:invalid tls config")
+	ErrServerStarted     = errors.New("CHAT:server already started")
+)
@@ -0,0 +1,221 @@
+package chat_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/chat"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/saitofun/chat/pkg/modules/profanity_words"
+	"github.com/saitofun/chat/pkg/modules/rooms"
+	"github.com/saitofun/qlib/net/qmsg"
+	"github.com/saitofun/qlib/net/qsock"
+	"github.com/stretchr/testify/require"
+)
+
+func start(t *testing.T, addr string, opts ...chat.ServerOptionSetter) *chat.Server {
+	srv, err := chat.NewServer(append(opts, chat.ServerOptionListenAddr(addr))...)
+	require.NoError(t, err)
+	require.NoError(t, srv.Start(context.Background()))
+	t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+	return srv
+}
+
+func dial(t *testing.T, srv *chat.Server) *qsock.Client {
+	cli, err := qsock.NewClient(
+		qsock.ClientOptionParser(protoc.Parser),
+		qsock.ClientOptionRemote(srv.Addr().String()),
+		qsock.ClientOptionProtocol(qsock.ProtocolTCP),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { cli.Close() })
+
+	rsp, err := cli.Request(protoc.NewHello(1, protoc.Version, protoc.Capabilities))
+	require.NoError(t, err)
+	require.True(t, rsp.(*protoc.Welcome).Accepted())
+	return cli
+}
+
+func request(t *testing.T, cli *qsock.Client, seq protoc.Seq, cmd protoc.GmCmd, arg string) interface{} {
+	rsp, err := cli.Request(protoc.NewInstruct(seq, cmd, arg))
+	require.NoError(t, err)
+	pl, err := models.DecodeResponse(rsp.(*protoc.Response))
+	require.NoError(t, err)
+	return pl
+}
+
+// recv 接收下一条指定类型的消息, 忽略心跳等其他消息
+func recv(t *testing.T, cli *qsock.Client, typ qmsg.Type) qmsg.Message {
+	for {
+		msg, err := cli.RecvMessage()
+		require.NoError(t, err)
+		if msg.Type() == typ {
+			return msg
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	tt := require.New(t)
+
+	a := start(t, "127.0.0.1:0", chat.ServerOptionDictionary(profanity_words.NewFilter("java")))
+	b := start(t, "127.0.0.1:0")
+	tt.NotEqual(a.Addr().String(), b.Addr().String())
+
+	// 两个服务的用户互相独立
+	alice, bob := dial(t, a), dial(t, a)
+	tt.Equal("alice", request(t, alice, 2, protoc.GmCreateUser, "alice secret1").(*models.UserProfile).Name)
+	tt.Equal("bob", request(t, bob, 2, protoc.GmCreateUser, "bob secret2").(*models.UserProfile).Name)
+	tt.Equal("alice", request(t, dial(t, b), 2, protoc.GmCreateUser, "alice secret1").(*models.UserProfile).Name)
+	tt.Nil(b.Users().GetByName("bob"))
+
+	request(t, alice, 3, protoc.GmCreateRoom, "lobby")
+	request(t, bob, 3, protoc.GmEnterRoom, "lobby")
+	tt.Equal(protoc.NoticeJoin, recv(t, alice, protoc.CmdNotice).(*protoc.Notice).Kind)
+	tt.NoError(alice.SendMessage(protoc.NewEcho(4, "", "java is fun")))
+	msg := recv(t, bob, protoc.CmdEcho).(*protoc.Echo)
+	tt.Equal("alice", msg.From)
+	tt.Equal("**** is fun", msg.Body)
+	tt.Nil(b.Rooms().GetByID(1))
+
+	// 关闭时先写出已发布的消息再通知并断开连接, 同一地址可重新启动
+	for i := 0; i < 5; i++ {
+		tt.NoError(alice.SendMessage(protoc.NewEcho(protoc.Seq(5+i), "", "bye")))
+	}
+	for deadline := time.Now().Add(time.Second); len(a.Rooms().GetByID(1).History(0, 10).Messages) < 6; {
+		tt.True(time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+	received := make(chan []qmsg.Message)
+	go func() {
+		var list []qmsg.Message
+		for {
+			msg, err := bob.RecvMessage()
+			if err != nil {
+				received <- list
+				return
+			}
+			if msg.Type() == protoc.CmdEcho || msg.Type() == protoc.CmdNotice {
+				list = append(list, msg)
+			}
+		}
+	}()
+	addr := a.Addr().String()
+	tt.NoError(a.Shutdown(context.Background()))
+	tt.Equal(protoc.NoticeShutdown, recv(t, alice, protoc.CmdNotice).(*protoc.Notice).Kind)
+	list := <-received
+	tt.Len(list, 6)
+	for _, msg := range list[:5] {
+		tt.Equal("bye", msg.(*protoc.Echo).Body)
+	}
+	tt.Equal(protoc.NoticeShutdown, list[5].(*protoc.Notice).Kind)
+	for deadline := time.Now().Add(time.Second); !alice.IsClosed(); {
+		tt.True(time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+	tt.Nil(a.Users().GetByClientID(addr))
+
+	c := start(t, addr)
+	tt.Equal(addr, c.Addr().String())
+	tt.Equal("alice", request(t, dial(t, c), 2, protoc.GmCreateUser, "alice secret1").(*models.UserProfile).Name)
+}
+
+func TestServerSettings(t *testing.T) {
+	tt := require.New(t)
+
+	// 各服务按自身配置运行, 互不影响
+	conf := config.Current()
+	conf.MaxUserDevices = 1
+	a := start(t, "127.0.0.1:0", chat.ServerOptionSettings(conf))
+	b := start(t, "127.0.0.1:0")
+
+	login := func(srv *chat.Server) error {
+		rsp, err := dial(t, srv).Request(protoc.NewInstruct(2, protoc.GmLogin, "alice secret1"))
+		tt.NoError(err)
+		_, err = models.DecodeResponse(rsp.(*protoc.Response))
+		return err
+	}
+	request(t, dial(t, a), 2, protoc.GmCreateUser, "alice secret1")
+	tt.Equal(errors.ErrTooManyDevices.Error(), login(a).Error())
+
+	request(t, dial(t, b), 2, protoc.GmCreateUser, "alice secret1")
+	tt.NoError(login(b))
+}
+
+func TestServerRestart(t *testing.T) {
+	tt := require.New(t)
+
+	// 共享的房间不受其中一个服务关闭的影响, 其他服务的用户仍收到进出通知
+	shared := rooms.New(nil, false, nil)
+	a := start(t, "127.0.0.1:0", chat.ServerOptionRooms(shared))
+	b := start(t, "127.0.0.1:0", chat.ServerOptionRooms(shared))
+	alice, bob := dial(t, a), dial(t, b)
+	request(t, alice, 2, protoc.GmCreateUser, "alice secret1")
+	request(t, bob, 2, protoc.GmCreateUser, "bob secret2")
+	request(t, alice, 3, protoc.GmCreateRoom, "lobby")
+	request(t, bob, 3, protoc.GmEnterRoom, "lobby")
+	tt.NoError(a.Shutdown(context.Background()))
+	n := recv(t, bob, protoc.CmdNotice).(*protoc.Notice)
+	tt.Equal(protoc.NoticeLeave, n.Kind)
+	tt.Contains(n.Body, "alice")
+
+	// 关闭后可再次启动, 自有房间恢复进出通知
+	tt.Nil(a.Addr())
+	srv := start(t, "127.0.0.1:0")
+	carol := dial(t, srv)
+	request(t, carol, 2, protoc.GmCreateUser, "carol secret3")
+	request(t, carol, 3, protoc.GmCreateRoom, "hall")
+	tt.NoError(srv.Shutdown(context.Background()))
+	tt.NoError(srv.Start(context.Background()))
+	tt.Equal(chat.ErrServerStarted, srv.Start(context.Background()))
+
+	carol, dave := dial(t, srv), dial(t, srv)
+	request(t, carol, 2, protoc.GmLogin, "carol secret3")
+	request(t, dave, 2, protoc.GmCreateUser, "dave secret4")
+	request(t, carol, 3, protoc.GmEnterRoom, "hall")
+	request(t, dave, 3, protoc.GmEnterRoom, "hall")
+	n = recv(t, carol, protoc.CmdNotice).(*protoc.Notice)
+	tt.Equal(protoc.NoticeJoin, n.Kind)
+	tt.Contains(n.Body, "dave")
+}
+
+func TestServerReap(t *testing.T) {
+	tt := require.New(t)
+
+	// 降低哈希强度, 避免创建用户耗时超过回收时间
+	conf := config.Current()
+	conf.PasswordCost = 4
+
+	srv := start(t, "127.0.0.1:0", chat.ServerOptionHeartbeat(200*time.Millisecond, 3), chat.ServerOptionSettings(conf))
+
+	// 未协商心跳的连接及未完成握手的连接静默超时后均被回收
+	silent, err := qsock.NewClient(
+		qsock.ClientOptionParser(protoc.Parser),
+		qsock.ClientOptionRemote(srv.Addr().String()),
+		qsock.ClientOptionProtocol(qsock.ProtocolTCP),
+	)
+	tt.NoError(err)
+	defer silent.Close()
+	rsp, err := silent.Request(protoc.NewHello(1, protoc.Version, protoc.Capabilities&^protoc.CapHeartbeat))
+	tt.NoError(err)
+	tt.False(rsp.(*protoc.Welcome).Caps.Has(protoc.CapHeartbeat))
+	request(t, silent, 2, protoc.GmCreateUser, "alice secret1")
+
+	idle, err := qsock.NewClient(
+		qsock.ClientOptionParser(protoc.Parser),
+		qsock.ClientOptionRemote(srv.Addr().String()),
+		qsock.ClientOptionProtocol(qsock.ProtocolTCP),
+	)
+	tt.NoError(err)
+	defer idle.Close()
+
+	for deadline := time.Now().Add(3 * time.Second); !silent.IsClosed() || !idle.IsClosed(); {
+		tt.True(time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+	tt.Nil(srv.Users().GetUserInfoByName("alice"))
+}
@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/saitofun/chat/pkg/depends/protoc"
+)
+
+// Draining 服务是否正在关闭, 关闭过程中不再接受新连接
+func (s *Server) Draining() bool { return atomic.LoadInt32(&s.draining) == 1 }
+
+// Shutdown 优雅关闭: 停止接受新连接, 等待房间内待投递消息写出后通知全部连接, 使关闭通知在已发布的消息之后送达,
+// 再注销本服务的在线用户并断开连接. ctx结束时不再等待消息写出, 立即通知、注销并断开.
+// 只暂停本服务创建的房间的进出通知, 与其他服务共享的房间不受影响; 关闭完成后可再次Start
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return nil
+	}
+	s.close()
+
+	err := s.rooms.Flush(ctx)
+	if s.ownRooms {
+		s.rooms.Mute(true)
+	}
+
+	s.peers.Range(func(p peer) bool {
+		if p.Negotiated() {
+			s.Notify(protoc.NoticeShutdown, "server shutting down", p.Node)
+		}
+		return true
+	})
+
+	s.peers.Range(func(p peer) bool {
+		s.users.UserOffline(p.Node.ID())
+		p.Node.Stop("server shutting down")
+		s.peers.Remove(p.Node)
+		return true
+	})
+
+	s.mtx.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.ctx, s.cancel, s.loopback, s.lns, s.ws = nil, nil, nil, nil, nil
+	s.listener = nil
+	atomic.StoreInt32(&s.draining, 0)
+	s.mtx.Unlock()
+	return err
+}
@@ -0,0 +1,578 @@
+package chatclient
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/saitofun/chat/pkg/depends/gateway"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	chaterrors "github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/saitofun/qlib/net/qmsg"
+	"github.com/saitofun/qlib/net/qsock"
+)
+
+var (
+	// ErrClosed 客户端已关闭
+	ErrClosed = errors.New("CHAT:client closed")
+	// ErrSessionTaken 会话已在其他连接上恢复, 不再重连
+	ErrSessionTaken = errors.New("CHAT:session taken by another connection")
+)
+
+// Client 聊天客户端, Dial完成握手后即可调用各指令方法, 可并发使用.
+// 房间消息写入Messages通道(或ClientOptionOnMessage回调), 接收协程同时负责应答服务端心跳,
+// 因此通道需要及时消费
+type Client struct {
+	*ClientOption
+	remote   string
+	cli      *qsock.Client
+	tunnel   *gateway.Tunnel
+	version  uint32
+	caps     protoc.Capability
+	user     *models.UserProfile
+	session  *models.Session // session 登录会话, 重连后以令牌恢复登录
+	room     int             // room 当前房间, 重连后重新进入
+	resume   *protoc.Resume  // resume 最后收到的房间消息, 重连后只补发之后的消息
+	lastID   uint64          // lastID 当前房间最后收到的消息ID, 用于去重
+	taken    bool            // taken 会话已在其他连接上恢复, 断开后不再重连
+	messages chan *protoc.Echo
+	done     chan struct{}
+	closing  chan struct{}
+	once     *sync.Once
+	err      error
+	mtx      *sync.Mutex
+}
+
+// Dial 连接remote并完成协议握手
+func Dial(remote string, options ...ClientOptionSetter) (*Client, error) {
+	c := &Client{
+		ClientOption: &ClientOption{
+			parser:  protoc.Parser,
+			timeout: 5 * time.Second,
+			buffer:  64,
+		},
+		remote:  remote,
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+		once:    &sync.Once{},
+		mtx:     &sync.Mutex{},
+	}
+	for _, opt := range options {
+		opt(c.ClientOption)
+	}
+	c.messages = make(chan *protoc.Echo, c.buffer)
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	go c.receiving()
+	return c, nil
+}
+
+// connect 建立连接并完成握手
+func (c *Client) connect() error {
+	var (
+		tunnel  *gateway.Tunnel
+		cli     *qsock.Client
+		err     error
+		options = []qsock.ClientOptionSetter{
+			qsock.ClientOptionParser(c.parser),
+			qsock.ClientOptionTimeout(c.timeout),
+		}
+	)
+	if c.tlsConfig != nil {
+		if tunnel, err = gateway.DialTLS(c.remote, c.tlsConfig, c.timeout); err != nil {
+			return err
+		}
+		cli, err = tunnel.Client(options...)
+	} else {
+		cli, err = qsock.NewClient(append(options,
+			qsock.ClientOptionRemote(c.remote),
+			qsock.ClientOptionProtocol(qsock.ProtocolTCP),
+		)...)
+	}
+	if err == nil {
+		var welcome *protoc.Welcome
+		if welcome, err = handshake(cli); err == nil {
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+			select {
+			case <-c.closing:
+				err = ErrClosed
+			default:
+				c.cli, c.tunnel = cli, tunnel
+				c.version, c.caps = welcome.Version, welcome.Caps
+				return nil
+			}
+		}
+		cli.Close(err)
+	}
+	if tunnel != nil {
+		_ = tunnel.Close()
+	}
+	return err
+}
+
+// handshake 协商协议版本和能力集, 客户端依赖结构化应答
+func handshake(cli *qsock.Client) (*protoc.Welcome, error) {
+	rsp, err := cli.Request(protoc.NewHello(seq(), protoc.Version, protoc.Capabilities))
+	if err != nil {
+		return nil, err
+	}
+	welcome, ok := rsp.(*protoc.Welcome)
+	if !ok {
+		return nil, fmt.Errorf("unexpected handshake response: %v", rsp)
+	}
+	if !welcome.Accepted() {
+		return nil, errors.New(welcome.Reason)
+	}
+	if !welcome.Caps.Has(protoc.CapResponse) {
+		return nil, protoc.ErrCapabilityMismatch
+	}
+	return welcome, nil
+}
+
+// link 当前连接
+func (c *Client) link() *qsock.Client {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.cli
+}
+
+// Version 协商的协议版本
+func (c *Client) Version() uint32 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.version
+}
+
+// Caps 协商的能力集
+func (c *Client) Caps() protoc.Capability {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.caps
+}
+
+// User 当前登录的用户, 未登录返回nil
+func (c *Client) User() *models.UserProfile {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.user
+}
+
+// Messages 房间消息, 客户端关闭后关闭
+func (c *Client) Messages() <-chan *protoc.Echo { return c.messages }
+
+// Done 客户端关闭后关闭; 启用重连时连接断开不会关闭
+func (c *Client) Done() <-chan struct{} { return c.done }
+
+// Err 客户端关闭的原因
+func (c *Client) Err() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.err
+}
+
+// Close 关闭客户端并断开连接, 不再重连; 可重复调用
+func (c *Client) Close() {
+	c.once.Do(func() { close(c.closing) })
+	c.disconnect()
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// disconnect 断开当前连接
+func (c *Client) disconnect() {
+	c.mtx.Lock()
+	cli, tunnel := c.cli, c.tunnel
+	c.mtx.Unlock()
+
+	if !cli.IsClosed() {
+		cli.Close("client closed")
+	}
+	if tunnel != nil {
+		_ = tunnel.Close()
+	}
+}
+
+// Register 注册用户并以该用户登录
+func (c *Client) Register(name, password string) (*models.UserProfile, error) {
+	return c.login(protoc.GmCreateUser, protoc.CredentialArg(name, password))
+}
+
+// Login 以已注册的用户及密码登录
+func (c *Client) Login(name, password string) (*models.UserProfile, error) {
+	return c.login(protoc.GmLogin, protoc.CredentialArg(name, password))
+}
+
+// Resume 以登录时获得的会话令牌恢复登录, 无需密码; 该用户在其他连接上的登录被解除
+func (c *Client) Resume(token string) (*models.UserProfile, error) {
+	return c.login(protoc.GmResume, token)
+}
+
+func (c *Client) login(cmd protoc.GmCmd, arg string) (*models.UserProfile, error) {
+	v, err := c.request(cmd, arg)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := v.(*models.UserProfile)
+	if !ok {
+		return nil, unexpected(v)
+	}
+	c.mtx.Lock()
+	c.user, c.session = user, user.Session
+	c.mtx.Unlock()
+	return user, nil
+}
+
+// Session 当前登录会话, 未登录返回nil
+func (c *Client) Session() *models.Session {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.session
+}
+
+// Logout 注销登录并吊销会话, all为true时吊销该用户的全部会话; 连接保留, 可重新登录
+func (c *Client) Logout(all bool) error {
+	arg := ""
+	if all {
+		arg = "all"
+	}
+	if _, err := c.request(protoc.GmLogout, arg); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	c.user, c.session, c.room, c.resume, c.lastID = nil, nil, 0, nil, 0
+	c.mtx.Unlock()
+	return nil
+}
+
+// Passwd 修改当前用户密码, 修改后该用户其他的会话失效
+func (c *Client) Passwd(old, password string) error {
+	_, err := c.request(protoc.GmPasswd, protoc.PasswdArg(old, password))
+	return err
+}
+
+// ListRooms 按房间号升序分页的房间列表, 从房间号from开始, limit为0使用服务端默认条数; 下一页从RoomPage.Next开始
+func (c *Client) ListRooms(from, limit int) (*models.RoomPage, error) {
+	v, err := c.request(protoc.GmRoomList, protoc.RoomListArg(from, limit))
+	if err != nil {
+		return nil, err
+	}
+	rooms, ok := v.(*models.RoomPage)
+	if !ok {
+		return nil, unexpected(v)
+	}
+	return rooms, nil
+}
+
+// CreateRoom 创建名为name的房间并进入, 房间号由服务端分配
+func (c *Client) CreateRoom(name, description string) (*models.RoomSummary, error) {
+	c.mtx.Lock()
+	c.resume, c.lastID = nil, 0
+	c.mtx.Unlock()
+	return c.entered(c.request(protoc.GmCreateRoom, protoc.CreateRoomArg(name, description)))
+}
+
+// NewRoom 新建无名房间并进入, 房间号由服务端分配
+func (c *Client) NewRoom() (*models.RoomSummary, error) {
+	return c.Join(protoc.RoomNew)
+}
+
+// EnterRoom 按房间号进入或切换房间
+func (c *Client) EnterRoom(id int) (*models.RoomSummary, error) {
+	return c.Join(strconv.Itoa(id))
+}
+
+// Join 按房间名或房间号进入或切换房间
+func (c *Client) Join(room string) (*models.RoomSummary, error) {
+	c.mtx.Lock()
+	c.resume, c.lastID = nil, 0
+	c.mtx.Unlock()
+	return c.enterRoom(room, nil)
+}
+
+func (c *Client) enterRoom(room string, resume *protoc.Resume) (*models.RoomSummary, error) {
+	return c.entered(c.request(protoc.GmEnterRoom, protoc.RoomArg(room, resume)))
+}
+
+// entered 记录进入的房间, 重连后重新进入
+func (c *Client) entered(v interface{}, err error) (*models.RoomSummary, error) {
+	if err != nil {
+		return nil, err
+	}
+	room, ok := v.(*models.RoomSummary)
+	if !ok {
+		return nil, unexpected(v)
+	}
+	c.mtx.Lock()
+	c.room = room.ID
+	c.mtx.Unlock()
+	return room, nil
+}
+
+// Topic 修改当前房间的话题, topic为空时只查询当前房间信息
+func (c *Client) Topic(topic string) (*models.RoomSummary, error) {
+	v, err := c.request(protoc.GmTopic, topic)
+	if err != nil {
+		return nil, err
+	}
+	room, ok := v.(*models.RoomSummary)
+	if !ok {
+		return nil, unexpected(v)
+	}
+	return room, nil
+}
+
+// Send 向当前房间发送消息, 写出后返回, 与随后的指令请求保持顺序; 服务端处理失败时通过ClientOptionOnError回调返回
+func (c *Client) Send(body string) error {
+	return c.link().WriteMessage(protoc.NewEcho(seq(), "", body))
+}
+
+// Direct 向用户to发送私信, 对方不在线时上线后送达
+func (c *Client) Direct(to, body string) error {
+	_, err := c.request(protoc.GmDirect, protoc.DirectArg(to, body))
+	return err
+}
+
+// Inbox 信箱中离线期间收到的消息, 登录后已自动投递过一次; 从序号offset开始, 下一页从Inbox.Next开始
+func (c *Client) Inbox(offset int) (*models.Inbox, error) {
+	v, err := c.request(protoc.GmInbox, protoc.InboxArg(offset))
+	if err != nil {
+		return nil, err
+	}
+	inbox, ok := v.(*models.Inbox)
+	if !ok {
+		return nil, unexpected(v)
+	}
+	return inbox, nil
+}
+
+// Stats 用户信息
+func (c *Client) Stats(name string) (*models.UserProfile, error) {
+	v, err := c.request(protoc.GmStats, name)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := v.(*models.UserProfile)
+	if !ok {
+		return nil, unexpected(v)
+	}
+	return user, nil
+}
+
+// Popular 房间热词, room为房间名或房间号, 为空表示当前房间
+func (c *Client) Popular(room string) (models.WordCounts, error) {
+	v, err := c.request(protoc.GmPopular, room)
+	if err != nil {
+		return nil, err
+	}
+	words, ok := v.(*models.WordCounts)
+	if !ok {
+		return nil, unexpected(v)
+	}
+	return *words, nil
+}
+
+// History 分页查询房间历史消息, room为房间名或房间号, 为空表示当前房间; before为0从最新消息开始,
+// limit为0使用服务端默认条数; 下一页以返回结果的Before()作为before
+func (c *Client) History(room string, before uint64, limit int) (*models.History, error) {
+	v, err := c.request(protoc.GmHistory, protoc.HistoryArg(room, before, limit))
+	if err != nil {
+		return nil, err
+	}
+	h, ok := v.(*models.History)
+	if !ok {
+		return nil, unexpected(v)
+	}
+	return h, nil
+}
+
+// Who 房间在线用户及空闲时长, room为房间名或房间号, 为空表示当前房间; 只列出用户名在after之后的成员,
+// 下一页从RoomMembers.After开始
+func (c *Client) Who(room, after string) (*models.RoomMembers, error) {
+	v, err := c.request(protoc.GmWho, protoc.WhoArg(room, after))
+	if err != nil {
+		return nil, err
+	}
+	members, ok := v.(*models.RoomMembers)
+	if !ok {
+		return nil, unexpected(v)
+	}
+	return members, nil
+}
+
+// request 发送指令并等待应答, 业务错误还原为pkg/errors中的错误
+func (c *Client) request(cmd protoc.GmCmd, arg string) (interface{}, error) {
+	rsp, err := c.link().Request(protoc.NewInstruct(seq(), cmd, arg))
+	if err != nil {
+		return nil, err
+	}
+	v, ok := rsp.(*protoc.Response)
+	if !ok {
+		return nil, unexpected(rsp)
+	}
+	return models.DecodeResponse(v)
+}
+
+// receiving 接收并处理服务端消息, 连接断开后按配置重连
+func (c *Client) receiving() {
+	defer close(c.done)
+	defer close(c.messages)
+
+	for {
+		err := c.recv(c.link())
+		if _, ok := err.(*protoc.ProtocolError); ok || c.backoff <= 0 || c.closed() {
+			c.stop(err)
+			return
+		}
+		if c.isTaken() {
+			c.stop(ErrSessionTaken)
+			return
+		}
+		if err = c.reconnect(); err != nil {
+			c.stop(err)
+			return
+		}
+	}
+}
+
+// recv 处理cli上的消息直到连接断开, 返回断开的原因
+func (c *Client) recv(cli *qsock.Client) error {
+	for {
+		msg, err := cli.RecvMessage()
+		if err != nil {
+			if qsock.IsTimeoutError(err) {
+				continue
+			}
+			return err
+		}
+		if msg == nil {
+			return qsock.ENodeClosed
+		}
+		if e, ok := msg.(*protoc.ProtocolError); ok {
+			if e.Local() {
+				_ = cli.WriteMessage(protoc.NewProtocolError(e.Seq, e.Reason))
+			}
+			return e
+		}
+		c.dispatch(cli, msg)
+	}
+}
+
+// dispatch 处理服务端推送的消息, 重复的房间消息(消息ID不大于已收到的)丢弃
+func (c *Client) dispatch(cli *qsock.Client, msg qmsg.Message) {
+	switch m := msg.(type) {
+	case *protoc.Echo:
+		c.mtx.Lock()
+		if m.MsgID != 0 && m.MsgID <= c.lastID {
+			c.mtx.Unlock()
+			return
+		}
+		c.resume, c.lastID = protoc.NewResume(m), m.MsgID
+		c.mtx.Unlock()
+		if c.onMessage != nil {
+			c.onMessage(m)
+		} else {
+			c.messages <- m
+		}
+	case *protoc.Direct:
+		if c.onDirect != nil {
+			c.onDirect(m)
+		} else if c.onMessage != nil {
+			c.onMessage(m.Echo())
+		} else {
+			c.messages <- m.Echo()
+		}
+	case *protoc.Notice:
+		if m.Kind == protoc.NoticeSessionTaken {
+			c.mtx.Lock()
+			c.taken = true
+			c.mtx.Unlock()
+		}
+		if c.onNotice != nil {
+			c.onNotice(m)
+		}
+	case *protoc.Ping:
+		_ = cli.SendMessage(protoc.NewPong(m))
+	case *protoc.Response:
+		if _, err := models.DecodeResponse(m); err != nil && c.onError != nil {
+			c.onError(m.Seq, err)
+		}
+	}
+}
+
+// reconnect 按指数退避重连直到成功、会话失效或客户端关闭
+func (c *Client) reconnect() error {
+	delay := c.backoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.closing:
+			return ErrClosed
+		case <-time.After(delay):
+		}
+		err := c.restore()
+		if c.onReconnect != nil {
+			c.onReconnect(attempt, err)
+		}
+		if err == nil {
+			return nil
+		}
+		if err == chaterrors.ErrInvalidSession {
+			return err
+		}
+		if delay *= 2; c.maxBackoff > 0 && delay > c.maxBackoff {
+			delay = c.maxBackoff
+		}
+	}
+}
+
+// restore 重新连接, 以会话令牌恢复登录并进入原房间
+func (c *Client) restore() error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	session, room, resume := c.session, c.room, c.resume
+	c.mtx.Unlock()
+
+	var err error
+	if session != nil {
+		_, err = c.Resume(session.Token)
+	}
+	if err == nil && session != nil && room != 0 {
+		_, err = c.enterRoom(strconv.Itoa(room), resume)
+	}
+	if err != nil {
+		c.disconnect()
+	}
+	return err
+}
+
+func (c *Client) isTaken() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.taken
+}
+
+func (c *Client) stop(err error) {
+	c.mtx.Lock()
+	c.err = err
+	c.mtx.Unlock()
+	c.disconnect()
+}
+
+func seq() protoc.Seq { return protoc.Seq(uuid.New().ID()) }
+
+func unexpected(v interface{}) error { return fmt.Errorf("unexpected response: %v", v) }
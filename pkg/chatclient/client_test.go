@@ -0,0 +1,747 @@
+package chatclient_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/chat"
+	"github.com/saitofun/chat/pkg/chatclient"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/saitofun/chat/pkg/modules/profanity_words"
+	"github.com/saitofun/chat/pkg/modules/rooms"
+	"github.com/saitofun/chat/pkg/modules/store"
+	"github.com/saitofun/chat/pkg/modules/users"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	tt := require.New(t)
+
+	srv, err := chat.NewServer(
+		chat.ServerOptionListenAddr("127.0.0.1:0"),
+		chat.ServerOptionDictionary(profanity_words.NewFilter("java")),
+	)
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	notices := make(chan *protoc.Notice, 1)
+	alice, err := chatclient.Dial(srv.Addr().String())
+	tt.NoError(err)
+	defer alice.Close()
+	bob, err := chatclient.Dial(srv.Addr().String(),
+		chatclient.ClientOptionOnNotice(func(n *protoc.Notice) { notices <- n }),
+	)
+	tt.NoError(err)
+	defer bob.Close()
+	tt.Equal(protoc.Version, alice.Version())
+	tt.True(alice.Caps().Has(protoc.CapResponse))
+
+	u, err := alice.Register("alice", "secret1")
+	tt.NoError(err)
+	tt.Equal("alice", u.Name)
+	tt.Equal(u, alice.User())
+	_, err = bob.Login("bob", "secret2")
+	tt.Equal(errors.ErrUserNotExisted, err)
+	_, err = bob.Register("bob", "secret2")
+	tt.NoError(err)
+
+	_, err = alice.EnterRoom(1)
+	tt.Equal(errors.ErrRoomIDNotExists, err)
+	_, err = alice.CreateRoom("123", "")
+	tt.Equal(errors.ErrInvalidRoomName, err)
+	room, err := alice.CreateRoom("Lobby", "welcome")
+	tt.NoError(err)
+	tt.Equal(1, room.ID)
+	tt.Equal("lobby", room.Name)
+	tt.Equal("alice", room.Creator)
+	_, err = bob.CreateRoom("lobby", "")
+	tt.Equal(errors.ErrRoomNameExists, err)
+	_, err = bob.Join("LOBBY")
+	tt.NoError(err)
+	rooms, err := bob.ListRooms(0, 0)
+	tt.NoError(err)
+	tt.Equal(1, rooms.Total)
+	tt.Equal("welcome", rooms.Rooms[0].Description)
+	tt.Equal(2, rooms.Rooms[0].UserCount)
+	who, err := bob.Who("", "")
+	tt.NoError(err)
+	tt.Equal(1, who.Room)
+	tt.Len(who.Members, 2)
+	tt.Equal("alice", who.Members[0].Name)
+
+	tt.NoError(alice.Send("java is fun"))
+	select {
+	case msg := <-bob.Messages():
+		tt.Equal("alice", msg.From)
+		tt.Equal("**** is fun", msg.Body)
+		tt.Equal(uint64(1), msg.MsgID)
+		tt.WithinDuration(time.Now(), msg.PubAt(), time.Minute)
+	case <-time.After(time.Second):
+		tt.Fail("message timeout")
+	}
+
+	words, err := bob.Popular("lobby")
+	tt.NoError(err)
+	tt.NotEmpty(words)
+	stats, err := bob.Stats("alice")
+	tt.NoError(err)
+	tt.Equal("alice", stats.Name)
+
+	// 服务关闭时收到通知, 连接断开
+	tt.NoError(srv.Shutdown(context.Background()))
+	select {
+	case n := <-notices:
+		tt.Equal(protoc.NoticeShutdown, n.Kind)
+	case <-time.After(time.Second):
+		tt.Fail("notice timeout")
+	}
+	select {
+	case <-bob.Done():
+		tt.Error(bob.Err())
+	case <-time.After(time.Second):
+		tt.Fail("close timeout")
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	tt := require.New(t)
+
+	// 两个服务共享用户和房间, bob所在的服务重启
+	us, rs := users.New(nil), rooms.New(nil, false, nil)
+	start := func(addr string) *chat.Server {
+		srv, err := chat.NewServer(
+			chat.ServerOptionListenAddr(addr),
+			chat.ServerOptionUsers(us),
+			chat.ServerOptionRooms(rs),
+		)
+		tt.NoError(err)
+		tt.NoError(srv.Start(context.Background()))
+		t.Cleanup(func() { _ = srv.Shutdown(context.Background()) })
+		return srv
+	}
+	a, b := start("127.0.0.1:0"), start("127.0.0.1:0")
+
+	reconnected := make(chan struct{}, 1)
+	alice, err := chatclient.Dial(b.Addr().String())
+	tt.NoError(err)
+	defer alice.Close()
+	bob, err := chatclient.Dial(a.Addr().String(),
+		chatclient.ClientOptionReconnect(10*time.Millisecond, 50*time.Millisecond),
+		chatclient.ClientOptionOnReconnect(func(_ int, err error) {
+			if err == nil {
+				reconnected <- struct{}{}
+			}
+		}),
+	)
+	tt.NoError(err)
+	defer bob.Close()
+
+	_, err = alice.Register("alice", "secret1")
+	tt.NoError(err)
+	_, err = bob.Register("bob", "secret2")
+	tt.NoError(err)
+	_, err = alice.CreateRoom("lobby", "")
+	tt.NoError(err)
+	_, err = bob.EnterRoom(1)
+	tt.NoError(err)
+
+	next := func() string {
+		select {
+		case msg := <-bob.Messages():
+			return msg.Body
+		case <-time.After(2 * time.Second):
+			tt.Fail("message timeout")
+			return ""
+		}
+	}
+
+	tt.NoError(alice.Send("before"))
+	tt.Equal("before", next())
+
+	addr := a.Addr().String()
+	tt.NoError(a.Shutdown(context.Background()))
+	for deadline := time.Now().Add(time.Second); us.GetUserInfoByName("bob") != nil; {
+		tt.True(time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+	}
+	tt.NoError(alice.Send("missed 1"))
+	tt.NoError(alice.Send("missed 2"))
+
+	// 重启后自动登录并进入原房间, 只补发断线期间的消息
+	start(addr)
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		tt.Fail("reconnect timeout")
+	}
+	tt.Equal("missed 1", next())
+	tt.Equal("missed 2", next())
+	tt.Equal("bob", us.GetUserInfoByName("bob").Name)
+	tt.NoError(alice.Send("after"))
+	tt.Equal("after", next())
+}
+
+func TestClientHistory(t *testing.T) {
+	tt := require.New(t)
+
+	defer func(n int) { config.MaxRoomHistory = n }(config.MaxRoomHistory)
+	config.MaxRoomHistory = 4
+
+	srv, err := chat.NewServer(chat.ServerOptionListenAddr("127.0.0.1:0"))
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	cli, err := chatclient.Dial(srv.Addr().String())
+	tt.NoError(err)
+	defer cli.Close()
+
+	_, err = cli.Register("alice", "secret1")
+	tt.NoError(err)
+	_, err = cli.History("", 0, 0)
+	tt.Equal(errors.ErrNotEnterRoom, err)
+	_, err = cli.History("2", 0, 0)
+	tt.Equal(errors.ErrRoomIDNotExists, err)
+	_, err = cli.EnterRoom(2)
+	tt.Equal(errors.ErrRoomIDNotExists, err)
+	room, err := cli.CreateRoom("history", "")
+	tt.NoError(err)
+	room, err = cli.Topic("paging")
+	tt.NoError(err)
+	tt.Equal("paging", room.Topic)
+
+	// 非创建者不能修改话题
+	bob, err := chatclient.Dial(srv.Addr().String())
+	tt.NoError(err)
+	defer bob.Close()
+	_, err = bob.Register("bob", "secret2")
+	tt.NoError(err)
+	_, err = bob.Join("history")
+	tt.NoError(err)
+	_, err = bob.Topic("hijacked")
+	tt.Equal(errors.ErrNotRoomCreator, err)
+	room, err = bob.Topic("")
+	tt.NoError(err)
+	tt.Equal("paging", room.Topic)
+	bob.Close()
+	for i := 1; i <= 5; i++ {
+		tt.NoError(cli.Send(fmt.Sprintf("msg %d", i)))
+	}
+
+	// 同一连接的消息按序处理, 查询时5条消息均已发布, 按保留策略只保留最后4条
+	h, err := cli.History("", 0, 3)
+	tt.NoError(err)
+	tt.Equal(room.ID, h.Room)
+	tt.Len(h.Messages, 3)
+	tt.Equal(uint64(3), h.Messages[0].ID)
+	tt.Equal("msg 5", h.Messages[2].Body)
+	tt.Equal("alice", h.Messages[2].From)
+	tt.Equal(uint64(3), h.Before())
+
+	h, err = cli.History("history", h.Before(), 3)
+	tt.NoError(err)
+	tt.Len(h.Messages, 1)
+	tt.Equal(uint64(2), h.Messages[0].ID)
+	tt.False(h.More)
+	tt.Zero(h.Before())
+
+	// 新建的无名房间分配新的房间号, 当前房间随之切换
+	created, err := cli.NewRoom()
+	tt.NoError(err)
+	tt.Equal(room.ID+1, created.ID)
+	tt.Empty(created.Name)
+	h, err = cli.History("", 0, 0)
+	tt.NoError(err)
+	tt.Equal(created.ID, h.Room)
+}
+
+func TestClientPassword(t *testing.T) {
+	tt := require.New(t)
+
+	defer func(n int, d time.Duration) {
+		config.LoginMaxFailures, config.LoginLockout = n, d
+	}(config.LoginMaxFailures, config.LoginLockout)
+	config.LoginMaxFailures, config.LoginLockout = 3, time.Hour
+
+	srv, err := chat.NewServer(chat.ServerOptionListenAddr("127.0.0.1:0"))
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	alice, err := chatclient.Dial(srv.Addr().String())
+	tt.NoError(err)
+	defer alice.Close()
+	eve, err := chatclient.Dial(srv.Addr().String())
+	tt.NoError(err)
+	defer eve.Close()
+
+	_, err = alice.Register("alice", "short")
+	tt.Equal(errors.ErrInvalidPassword, err)
+	_, err = alice.Register("alice", "secret1")
+	tt.NoError(err)
+	tt.NotContains(srv.Users().GetByName("alice").PasswordHash, "secret1")
+
+	tt.Equal(errors.ErrWrongPassword, alice.Passwd("wrong", "secret2"))
+	tt.NoError(alice.Passwd("secret1", "secret2"))
+
+	// 连续失败达到上限后锁定, 正确的密码也无法登录
+	for _, pw := range []string{"secret1", "secret3", ""} {
+		_, err = eve.Login("alice", pw)
+		tt.Equal(errors.ErrWrongPassword, err)
+	}
+	_, err = eve.Login("alice", "secret2")
+	tt.Equal(errors.ErrUserLocked, err)
+}
+
+func TestClientPasswordConcurrent(t *testing.T) {
+	tt := require.New(t)
+
+	defer func(n int, d time.Duration) {
+		config.LoginMaxFailures, config.LoginLockout = n, d
+	}(config.LoginMaxFailures, config.LoginLockout)
+	config.LoginMaxFailures, config.LoginLockout = 3, time.Hour
+
+	srv, err := chat.NewServer(chat.ServerOptionListenAddr("127.0.0.1:0"))
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	alice, err := chatclient.Dial(srv.Addr().String())
+	tt.NoError(err)
+	defer alice.Close()
+	_, err = alice.Register("alice", "secret1")
+	tt.NoError(err)
+
+	// 并发的错误密码登录中只有上限次数完成校验, 其余直接锁定
+	const n = 10
+	clients := make([]*chatclient.Client, n)
+	for i := range clients {
+		clients[i], err = chatclient.Dial(srv.Addr().String())
+		tt.NoError(err)
+		defer clients[i].Close()
+	}
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, n)
+	)
+	for i, cli := range clients {
+		wg.Add(1)
+		go func(i int, cli *chatclient.Client) {
+			defer wg.Done()
+			_, errs[i] = cli.Login("alice", "wrong1")
+		}(i, cli)
+	}
+	wg.Wait()
+
+	wrong := 0
+	for _, err := range errs {
+		if err == errors.ErrWrongPassword {
+			wrong++
+		} else {
+			tt.Equal(errors.ErrUserLocked, err)
+		}
+	}
+	tt.Equal(config.LoginMaxFailures, wrong)
+	_, err = clients[0].Login("alice", "secret1")
+	tt.Equal(errors.ErrUserLocked, err)
+}
+
+func TestClientPasswordNotSet(t *testing.T) {
+	tt := require.New(t)
+
+	// 升级前注册的用户没有密码哈希
+	st, err := store.Open(filepath.Join(t.TempDir(), "chat.jsonl"), nil)
+	tt.NoError(err)
+	defer st.Close()
+	tt.NoError(st.SaveUser(&models.User{Name: "legacy", CreatedAt: time.Now()}))
+
+	srv, err := chat.NewServer(chat.ServerOptionListenAddr("127.0.0.1:0"), chat.ServerOptionStore(st))
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	cli, err := chatclient.Dial(srv.Addr().String())
+	tt.NoError(err)
+	defer cli.Close()
+
+	// 任何密码均不能登录, 也不计入失败次数
+	for _, pw := range []string{"", "secret1", "secret2", "secret3", "secret4", "secret5"} {
+		_, err = cli.Login("legacy", pw)
+		tt.Equal(errors.ErrPasswordNotSet, err)
+	}
+
+	tt.Equal(errors.ErrUserNotExisted, srv.Users().SetPassword("nobody", "secret1"))
+	tt.Equal(errors.ErrInvalidPassword, srv.Users().SetPassword("legacy", "short"))
+	tt.NoError(srv.Users().SetPassword("legacy", "secret1"))
+	_, err = cli.Login("legacy", "")
+	tt.Equal(errors.ErrWrongPassword, err)
+	_, err = cli.Login("legacy", "secret1")
+	tt.NoError(err)
+}
+
+func TestClientSession(t *testing.T) {
+	tt := require.New(t)
+
+	srv, err := chat.NewServer(chat.ServerOptionListenAddr("127.0.0.1:0"))
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	dial := func(opts ...chatclient.ClientOptionSetter) *chatclient.Client {
+		cli, err := chatclient.Dial(srv.Addr().String(), opts...)
+		tt.NoError(err)
+		t.Cleanup(cli.Close)
+		return cli
+	}
+
+	phone := dial(chatclient.ClientOptionReconnect(10*time.Millisecond, 50*time.Millisecond))
+	u, err := phone.Register("alice", "secret1")
+	tt.NoError(err)
+	tt.NotNil(u.Session)
+	tt.Equal(u.Session, phone.Session())
+	tt.True(u.Session.ExpiresAt.After(time.Now()))
+
+	// 其他连接以令牌恢复会话, 原连接收到通知后断开且不再重连
+	laptop := dial()
+	_, err = laptop.Resume("invalid")
+	tt.Equal(errors.ErrInvalidSession, err)
+	u, err = laptop.Resume(phone.Session().Token)
+	tt.NoError(err)
+	tt.Equal("alice", u.Name)
+	select {
+	case <-phone.Done():
+		tt.Equal(chatclient.ErrSessionTaken, phone.Err())
+	case <-time.After(time.Second):
+		tt.Fail("session taken timeout")
+	}
+
+	// 注销后会话吊销, 连接可重新登录
+	token := laptop.Session().Token
+	tt.NoError(laptop.Logout(false))
+	tt.Nil(laptop.User())
+	_, err = dial().Resume(token)
+	tt.Equal(errors.ErrInvalidSession, err)
+	_, err = laptop.Login("alice", "secret1")
+	tt.NoError(err)
+}
+
+func TestClientDevices(t *testing.T) {
+	tt := require.New(t)
+
+	defer func(n int) { config.MaxUserDevices = n }(config.MaxUserDevices)
+	config.MaxUserDevices = 2
+
+	srv, err := chat.NewServer(chat.ServerOptionListenAddr("127.0.0.1:0"))
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	dial := func() *chatclient.Client {
+		cli, err := chatclient.Dial(srv.Addr().String())
+		tt.NoError(err)
+		t.Cleanup(cli.Close)
+		return cli
+	}
+	next := func(cli *chatclient.Client) *protoc.Echo {
+		select {
+		case msg := <-cli.Messages():
+			return msg
+		case <-time.After(time.Second):
+			tt.Fail("message timeout")
+			return nil
+		}
+	}
+
+	laptop, phone, bob := dial(), dial(), dial()
+	_, err = laptop.Register("alice", "secret1")
+	tt.NoError(err)
+	_, err = phone.Login("alice", "secret1")
+	tt.NoError(err)
+	_, err = dial().Login("alice", "secret1")
+	tt.Equal(errors.ErrTooManyDevices, err)
+	_, err = bob.Register("bob", "secret2")
+	tt.NoError(err)
+	_, err = laptop.CreateRoom("lobby", "")
+	tt.NoError(err)
+	for _, cli := range []*chatclient.Client{phone, bob} {
+		_, err = cli.EnterRoom(1)
+		tt.NoError(err)
+	}
+	rooms, err := bob.ListRooms(1, 1)
+	tt.NoError(err)
+	tt.False(rooms.More)
+	tt.Equal(2, rooms.Rooms[0].UserCount)
+
+	// 一台设备发送的消息投递给房间内其他用户及该用户的其他设备, 不回显给发送的设备
+	tt.NoError(laptop.Send("from laptop"))
+	tt.Equal("from laptop", next(phone).Body)
+	tt.Equal("from laptop", next(bob).Body)
+	tt.NoError(phone.Send("from phone"))
+	tt.Equal("from phone", next(laptop).Body)
+	tt.Equal("from phone", next(bob).Body)
+
+	p, err := bob.Stats("alice")
+	tt.NoError(err)
+	tt.Equal(2, p.Devices)
+	loginAt := p.LastLogin
+
+	// 部分设备下线不影响在线状态及在线时长
+	phone.Close()
+	for deadline := time.Now().Add(time.Second); p.Devices != 1; {
+		tt.True(time.Now().Before(deadline))
+		time.Sleep(10 * time.Millisecond)
+		p, err = bob.Stats("alice")
+		tt.NoError(err)
+	}
+	tt.True(p.LastLogin.Equal(loginAt))
+	tt.True(srv.Users().GetByName("alice").LogoffAt.IsZero())
+
+	// 新设备进入房间时收到该用户其他设备发送的最近消息
+	tablet := dial()
+	_, err = tablet.Login("alice", "secret1")
+	tt.NoError(err)
+	_, err = tablet.EnterRoom(1)
+	tt.NoError(err)
+	tt.Equal("from laptop", next(tablet).Body)
+	tt.Equal("from phone", next(tablet).Body)
+}
+
+func TestClientSwitchRoom(t *testing.T) {
+	tt := require.New(t)
+
+	defer func(rooms string) { config.QuietRooms = rooms }(config.QuietRooms)
+	config.QuietRooms = "1,2"
+
+	srv, err := chat.NewServer(chat.ServerOptionListenAddr("127.0.0.1:0"))
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	cli, err := chatclient.Dial(srv.Addr().String())
+	tt.NoError(err)
+	defer cli.Close()
+	_, err = cli.Register("alice", "secret1")
+	tt.NoError(err)
+	_, err = cli.CreateRoom("r1", "")
+	tt.NoError(err)
+	_, err = cli.CreateRoom("r2", "")
+	tt.NoError(err)
+
+	// 并发切换房间后只在最后进入的房间内, 已离开的房间不残留订阅
+	for i := 0; i < 200; i++ {
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for j, name := range []string{"r1", "r2"} {
+			wg.Add(1)
+			go func(j int, name string) {
+				defer wg.Done()
+				_, errs[j] = cli.Join(name)
+			}(j, name)
+		}
+		wg.Wait()
+		tt.NoError(errs[0])
+		tt.NoError(errs[1])
+		tt.Equal(1, srv.Rooms().GetByID(1).UserCount()+srv.Rooms().GetByID(2).UserCount())
+	}
+}
+
+func TestClientDirect(t *testing.T) {
+	tt := require.New(t)
+
+	defer func(n int) { config.MaxMailboxSize = n }(config.MaxMailboxSize)
+	config.MaxMailboxSize = 2
+
+	srv, err := chat.NewServer(
+		chat.ServerOptionListenAddr("127.0.0.1:0"),
+		chat.ServerOptionDictionary(profanity_words.NewFilter("java")),
+	)
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	dial := func() (*chatclient.Client, chan *protoc.Direct) {
+		ch := make(chan *protoc.Direct, 4)
+		cli, err := chatclient.Dial(srv.Addr().String(),
+			chatclient.ClientOptionOnDirect(func(m *protoc.Direct) { ch <- m }),
+		)
+		tt.NoError(err)
+		t.Cleanup(cli.Close)
+		return cli, ch
+	}
+	next := func(ch chan *protoc.Direct) *protoc.Direct {
+		select {
+		case m := <-ch:
+			return m
+		case <-time.After(time.Second):
+			tt.Fail("direct message timeout")
+			return nil
+		}
+	}
+
+	alice, _ := dial()
+	_, err = alice.Register("alice", "secret1")
+	tt.NoError(err)
+	tt.Equal(errors.ErrUserNotExisted, alice.Direct("bob", "hi"))
+
+	// 离线期间的私信存入信箱, 登录后按顺序投递, 超出容量时丢弃最早的
+	bob, _ := dial()
+	_, err = bob.Register("bob", "secret2")
+	tt.NoError(err)
+	tt.NoError(bob.Logout(false))
+	tt.NoError(alice.Direct("bob", "dropped"))
+	tt.NoError(alice.Direct("bob", "java is fun"))
+	tt.NoError(alice.Direct("bob", "again"))
+
+	bob, inbox := dial()
+	_, err = bob.Login("bob", "secret2")
+	tt.NoError(err)
+	m := next(inbox)
+	tt.Equal("alice", m.From)
+	tt.Equal("bob", m.To)
+	tt.Equal("**** is fun", m.Body)
+	tt.Equal("again", next(inbox).Body)
+	mails, err := bob.Inbox(0)
+	tt.NoError(err)
+	tt.Len(mails.Mails, 2)
+	tt.False(mails.More)
+	tt.Equal("**** is fun", mails.Mails[0].Body)
+	tt.True(mails.Mails[1].Delivered)
+
+	// 在线私信投递给收件人, 并同步给发件人的其他设备
+	laptop, outbox := dial()
+	_, err = laptop.Login("alice", "secret1")
+	tt.NoError(err)
+	tt.NoError(alice.Direct("bob", "online"))
+	tt.Equal("online", next(inbox).Body)
+	tt.Equal("bob", next(outbox).To)
+}
+
+func TestClientMention(t *testing.T) {
+	tt := require.New(t)
+
+	srv, err := chat.NewServer(chat.ServerOptionListenAddr("127.0.0.1:0"))
+	tt.NoError(err)
+	tt.NoError(srv.Start(context.Background()))
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+
+	dial := func() (*chatclient.Client, chan *protoc.Notice) {
+		ch := make(chan *protoc.Notice, 4)
+		cli, err := chatclient.Dial(srv.Addr().String(),
+			chatclient.ClientOptionOnNotice(func(n *protoc.Notice) { ch <- n }),
+		)
+		tt.NoError(err)
+		t.Cleanup(cli.Close)
+		return cli, ch
+	}
+	next := func(ch chan *protoc.Notice) *protoc.Notice {
+		select {
+		case n := <-ch:
+			return n
+		case <-time.After(time.Second):
+			tt.Fail("notice timeout")
+			return nil
+		}
+	}
+
+	alice, _ := dial()
+	bob, _ := dial()
+	carol, notices := dial()
+	dave, _ := dial()
+	for name, cli := range map[string]*chatclient.Client{
+		"alice": alice, "bob": bob, "carol": carol, "dave": dave,
+	} {
+		_, err = cli.Register(name, "secret1")
+		tt.NoError(err)
+	}
+	tt.NoError(dave.Logout(false))
+	_, err = alice.CreateRoom("one", "")
+	tt.NoError(err)
+	_, err = bob.EnterRoom(1)
+	tt.NoError(err)
+	_, err = carol.CreateRoom("two", "")
+	tt.NoError(err)
+
+	// 房间内的用户收到携带提及列表的消息, 不在房间内的用户收到通知, 离线用户存入信箱
+	tt.NoError(alice.Send("hi @bob @carol, @dave! @nobody"))
+	select {
+	case msg := <-bob.Messages():
+		tt.Equal([]string{"bob", "carol", "dave"}, msg.Mentions)
+		tt.True(msg.Mentioned("bob"))
+	case <-time.After(time.Second):
+		tt.Fail("message timeout")
+	}
+	n := next(notices)
+	tt.Equal(protoc.NoticeMention, n.Kind)
+	tt.Contains(n.Body, "alice")
+
+	dave, notices = dial()
+	_, err = dave.Login("dave", "secret1")
+	tt.NoError(err)
+	tt.Equal(protoc.NoticeMention, next(notices).Kind)
+	mails, err := dave.Inbox(0)
+	tt.NoError(err)
+	tt.Len(mails.Mails, 1)
+	tt.Equal(models.MailMention, mails.Mails[0].Kind)
+	tt.Equal(1, mails.Mails[0].Room)
+}
+
+func TestClientStore(t *testing.T) {
+	tt := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "chat.jsonl")
+	run := func(f func(cli *chatclient.Client)) {
+		st, err := store.Open(path, nil)
+		tt.NoError(err)
+		defer st.Close()
+		srv, err := chat.NewServer(chat.ServerOptionListenAddr("127.0.0.1:0"), chat.ServerOptionStore(st))
+		tt.NoError(err)
+		tt.NoError(srv.Start(context.Background()))
+		defer func() { tt.NoError(srv.Shutdown(context.Background())) }()
+
+		cli, err := chatclient.Dial(srv.Addr().String())
+		tt.NoError(err)
+		defer cli.Close()
+		f(cli)
+	}
+
+	run(func(cli *chatclient.Client) {
+		_, err := cli.Register("alice", "secret1")
+		tt.NoError(err)
+		_, err = cli.CreateRoom("lobby", "")
+		tt.NoError(err)
+		_, err = cli.Topic("stored")
+		tt.NoError(err)
+		tt.NoError(cli.Send("hello"))
+		_, err = cli.History("", 0, 0)
+		tt.NoError(err)
+	})
+
+	// 重启后用户、房间及消息仍在, 消息ID继续递增
+	run(func(cli *chatclient.Client) {
+		_, err := cli.Register("alice", "secret1")
+		tt.Equal(errors.ErrUserExisted, err)
+		_, err = cli.Login("alice", "secret1")
+		tt.NoError(err)
+		rooms, err := cli.ListRooms(0, 0)
+		tt.NoError(err)
+		tt.Len(rooms.Rooms, 1)
+		room, err := cli.Join("lobby")
+		tt.NoError(err)
+		tt.Equal("stored", room.Topic)
+		tt.Equal("alice", room.Creator)
+		tt.NoError(cli.Send("again"))
+		h, err := cli.History("lobby", 0, 0)
+		tt.NoError(err)
+		tt.Len(h.Messages, 2)
+		tt.Equal("hello", h.Messages[0].Body)
+		tt.Equal(uint64(2), h.Messages[1].ID)
+	})
+}
@@ -0,0 +1,93 @@
+package chatclient
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/qlib/net/qmsg"
+)
+
+type ClientOption struct {
+	parser    qmsg.Parser             // parser 协议解析器, 默认protoc.Parser
+	tlsConfig *tls.Config             // tlsConfig 不为空时经TLS连接
+	timeout   time.Duration           // timeout 连接及请求超时
+	buffer    int                     // buffer 房间消息通道容量
+	onMessage func(*protoc.Echo)      // onMessage 房间消息回调, 设置后不再写入Messages通道
+	onNotice  func(*protoc.Notice)    // onNotice 服务端通知回调
+	onDirect  func(*protoc.Direct)    // onDirect 私信回调, 未设置时私信以回显消息写入Messages通道
+	onError   func(protoc.Seq, error) // onError 无对应请求的错误应答回调, 如发送消息失败
+
+	backoff     time.Duration                // backoff 首次重连间隔, 0不重连
+	maxBackoff  time.Duration                // maxBackoff 最大重连间隔
+	onReconnect func(attempt int, err error) // onReconnect 重连尝试回调
+}
+
+type ClientOptionSetter func(*ClientOption)
+
+func ClientOptionParser(v qmsg.Parser) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.parser = v
+	}
+}
+
+func ClientOptionTLS(v *tls.Config) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.tlsConfig = v
+	}
+}
+
+func ClientOptionTimeout(v time.Duration) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.timeout = v
+	}
+}
+
+func ClientOptionMessageBuffer(v int) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.buffer = v
+	}
+}
+
+// ClientOptionOnMessage 房间消息回调, 在接收协程中调用, 不应阻塞
+func ClientOptionOnMessage(f func(*protoc.Echo)) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.onMessage = f
+	}
+}
+
+// ClientOptionOnNotice 服务端通知回调, 在接收协程中调用, 不应阻塞
+func ClientOptionOnNotice(f func(*protoc.Notice)) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.onNotice = f
+	}
+}
+
+// ClientOptionOnDirect 私信回调, 在接收协程中调用, 不应阻塞
+func ClientOptionOnDirect(f func(*protoc.Direct)) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.onDirect = f
+	}
+}
+
+// ClientOptionOnError 无对应请求的错误应答回调, seq为出错消息的序列号
+func ClientOptionOnError(f func(protoc.Seq, error)) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.onError = f
+	}
+}
+
+// ClientOptionReconnect 连接断开后自动重连, 重试间隔从backoff开始按指数增长至max;
+// 重连后以会话令牌恢复登录并进入原房间, 只补发断线期间错过的消息
+func ClientOptionReconnect(backoff, max time.Duration) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.backoff, o.maxBackoff = backoff, max
+	}
+}
+
+// ClientOptionOnReconnect 每次重连尝试后回调, err为nil表示重连成功
+func ClientOptionOnReconnect(f func(attempt int, err error)) ClientOptionSetter {
+	return func(o *ClientOption) {
+		o.onReconnect = f
+	}
+}
@@ -0,0 +1,84 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// DialTLS 以conf连接远端remote并完成TLS握手, 返回本地隧道;
+// 以隧道的Client()创建的qsock.Client即可透明地使用TLS
+func DialTLS(remote string, conf *tls.Config, timeout time.Duration) (*Tunnel, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", remote, conf)
+	if err != nil {
+		return nil, err
+	}
+	t, err := NewTunnel(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// ServerTLSConfig 加载服务端证书和私钥; clientCA不为空时要求并校验客户端证书(双向TLS)
+func ServerTLSConfig(cert, key, clientCA string) (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pool, err := certPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// ClientTLSConfig 客户端TLS配置; ca为空时使用系统根证书, serverName为空时按连接地址校验,
+// cert和key不为空时携带客户端证书
+func ClientTLSConfig(ca, serverName, cert, key string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if ca != "" {
+		pool, err := certPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	return conf, nil
+}
+
+func certPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrNoCertificate
+	}
+	return pool, nil
+}
+
+var ErrNoCertificate = errors.New("CHAT:no certificate found in pem")
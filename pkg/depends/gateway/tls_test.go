@@ -0,0 +1,190 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/qlib/net/qsock"
+	"github.com/stretchr/testify/require"
+)
+
+// pki 测试用自签名CA及其签发的证书
+type pki struct {
+	dir  string
+	ca   *x509.Certificate
+	key  *ecdsa.PrivateKey
+	seri int64
+}
+
+func newPKI(t *testing.T) *pki {
+	p := &pki{dir: t.TempDir()}
+	p.ca, p.key = p.issue(t, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "chat test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return p
+}
+
+// issue 签发证书并写入dir/name.pem和dir/name.key, CA自签
+func (p *pki) issue(t *testing.T, name string, tpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	p.seri++
+	tpl.SerialNumber = big.NewInt(p.seri)
+	tpl.NotBefore = time.Now().Add(-time.Minute)
+	tpl.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := tpl, key
+	if p.ca != nil {
+		parent, signer = p.ca, p.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	dat, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(p.path(name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(p.path(name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: dat}), 0600))
+	return cert, key
+}
+
+func (p *pki) path(name string) string { return filepath.Join(p.dir, name) }
+
+// welcome 经lb的隧道处理conn, 应答一次握手
+func welcome(lb *Loopback, conn net.Conn) {
+	tun, err := lb.Open(conn)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	cli, err := tun.Client(qsock.ClientOptionParser(protoc.Parser))
+	if err != nil {
+		_ = tun.Close()
+		return
+	}
+	defer cli.Close()
+	msg, err := cli.RecvMessage()
+	if hello, ok := msg.(*protoc.Hello); ok && err == nil {
+		_ = cli.WriteMessage(protoc.NewWelcome(hello.Seq, hello.Version, hello.Caps, ""))
+		_, _ = cli.RecvMessage()
+	}
+}
+
+func TestTLS(t *testing.T) {
+	tt := require.New(t)
+
+	p := newPKI(t)
+	p.issue(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "chat.test"},
+		DNSNames:    []string{"chat.test"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	p.issue(t, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	// serve 接受TLS连接, 经本地隧道交给qsock.Client应答握手
+	serve := func(clientCA string) string {
+		conf, err := ServerTLSConfig(p.path("server.pem"), p.path("server.key"), clientCA)
+		tt.NoError(err)
+		lb, err := NewLoopback()
+		tt.NoError(err)
+		t.Cleanup(func() { _ = lb.Close() })
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+		tt.NoError(err)
+		t.Cleanup(func() { _ = ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go welcome(lb, conn)
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	hello := func(tun *Tunnel) {
+		cli, err := tun.Client(qsock.ClientOptionParser(protoc.Parser))
+		tt.NoError(err)
+		defer cli.Close()
+		rsp, err := cli.Request(protoc.NewHello(1, protoc.Version, protoc.Capabilities))
+		tt.NoError(err)
+		tt.Equal(protoc.NewWelcome(1, protoc.Version, protoc.Capabilities, ""), rsp)
+	}
+
+	t.Run("ServerAuth", func(t *testing.T) {
+		addr := serve("")
+
+		conf, err := ClientTLSConfig(p.path("ca.pem"), "chat.test", "", "")
+		tt.NoError(err)
+		tun, err := DialTLS(addr, conf, time.Second)
+		tt.NoError(err)
+		defer tun.Close()
+		tt.True(tun.ConnectionState().HandshakeComplete)
+		hello(tun)
+
+		// 不受信任的证书
+		conf, err = ClientTLSConfig("", "chat.test", "", "")
+		tt.NoError(err)
+		_, err = DialTLS(addr, conf, time.Second)
+		tt.Error(err)
+
+		// 服务名不匹配
+		conf, err = ClientTLSConfig(p.path("ca.pem"), "other.test", "", "")
+		tt.NoError(err)
+		_, err = DialTLS(addr, conf, time.Second)
+		tt.Error(err)
+	})
+
+	t.Run("MutualAuth", func(t *testing.T) {
+		addr := serve(p.path("ca.pem"))
+
+		conf, err := ClientTLSConfig(p.path("ca.pem"), "chat.test", p.path("client.pem"), p.path("client.key"))
+		tt.NoError(err)
+		tun, err := DialTLS(addr, conf, time.Second)
+		tt.NoError(err)
+		defer tun.Close()
+		hello(tun)
+
+		// 未携带客户端证书, TLS1.3下握手错误在首次读取时返回
+		conf, err = ClientTLSConfig(p.path("ca.pem"), "chat.test", "", "")
+		tt.NoError(err)
+		conn, err := tls.Dial("tcp", addr, conf)
+		if err == nil {
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+		}
+		tt.Error(err)
+	})
+
+	t.Run("BadCA", func(t *testing.T) {
+		tt.NoError(os.WriteFile(p.path("empty.pem"), []byte("not a pem"), 0600))
+		_, err := ClientTLSConfig(p.path("empty.pem"), "", "", "")
+		tt.Equal(ErrNoCertificate, err)
+		_, err = ServerTLSConfig(p.path("server.pem"), p.path("server.key"), p.path("empty.pem"))
+		tt.Equal(ErrNoCertificate, err)
+	})
+}
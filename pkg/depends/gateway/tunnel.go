@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/saitofun/qlib/net/qsock"
+)
+
+// TokenLen 隧道令牌长度
+const TokenLen = 32
+
+// Loopback 本地回环监听, 为多条隧道共用. qsock只能自行拨号或监听建立连接, 借助隧道可将任意net.Conn
+// (如TLS连接、自行接受的连接)交给qsock处理. 本地连接须先发送隧道令牌, 令牌匹配后才与对应的远端连接
+// 双向转发, 令牌错误或超时的连接直接关闭; 每个令牌只能使用一次
+type Loopback struct {
+	ln      net.Listener
+	pending map[string]*Tunnel
+	mtx     *sync.Mutex
+}
+
+// NewLoopback 在127.0.0.1的随机端口上监听
+func NewLoopback() (*Loopback, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	l := &Loopback{ln: ln, pending: make(map[string]*Tunnel), mtx: &sync.Mutex{}}
+	go l.serve()
+	return l, nil
+}
+
+// Addr 本地明文地址
+func (l *Loopback) Addr() string { return l.ln.Addr().String() }
+
+// Open 为conn创建隧道, 等待持有令牌的本地连接接入
+func (l *Loopback) Open(conn net.Conn) (*Tunnel, error) {
+	token := make([]byte, TokenLen/2)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	t := &Tunnel{lb: l, token: []byte(hex.EncodeToString(token)), conn: conn}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.pending == nil {
+		return nil, net.ErrClosed
+	}
+	l.pending[string(t.token)] = t
+	return t, nil
+}
+
+// Close 关闭监听, 已建立的隧道不受影响
+func (l *Loopback) Close() error {
+	l.mtx.Lock()
+	l.pending = nil
+	l.mtx.Unlock()
+	return l.ln.Close()
+}
+
+func (l *Loopback) serve() {
+	for {
+		local, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		go l.attach(local)
+	}
+}
+
+// attach 读取本地连接的令牌, 匹配后开始转发
+func (l *Loopback) attach(local net.Conn) {
+	token := make([]byte, TokenLen)
+	_ = local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(local, token); err != nil {
+		_ = local.Close()
+		return
+	}
+	_ = local.SetReadDeadline(time.Time{})
+
+	t := l.take(string(token))
+	if t == nil {
+		_ = local.Close()
+		return
+	}
+	if t.owned {
+		_ = l.Close()
+	}
+	pipe(local, t.conn)
+}
+
+// take 取出并移除令牌对应的隧道
+func (l *Loopback) take(token string) *Tunnel {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	t, ok := l.pending[token]
+	if ok {
+		delete(l.pending, token)
+	}
+	return t
+}
+
+// Tunnel 本地隧道, 持有令牌的一条本地连接与conn双向转发
+type Tunnel struct {
+	lb    *Loopback
+	token []byte
+	conn  net.Conn
+	owned bool // owned lb为隧道独占, 本地连接接入或隧道关闭时一并关闭
+}
+
+// NewTunnel 创建conn的本地隧道, 使用独占的回环监听
+func NewTunnel(conn net.Conn) (*Tunnel, error) {
+	lb, err := NewLoopback()
+	if err != nil {
+		return nil, err
+	}
+	t, err := lb.Open(conn)
+	if err != nil {
+		_ = lb.Close()
+		return nil, err
+	}
+	t.owned = true
+	return t, nil
+}
+
+// Addr 本地明文地址
+func (t *Tunnel) Addr() string { return t.lb.Addr() }
+
+// Token 本地连接须首先发送的令牌
+func (t *Tunnel) Token() []byte { return t.token }
+
+// Conn 隧道远端连接
+func (t *Tunnel) Conn() net.Conn { return t.conn }
+
+// ConnectionState 远端为TLS连接时返回连接状态
+func (t *Tunnel) ConnectionState() tls.ConnectionState {
+	if c, ok := t.conn.(*tls.Conn); ok {
+		return c.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+// Client 创建连接隧道的qsock.Client并发送令牌
+func (t *Tunnel) Client(options ...qsock.ClientOptionSetter) (*qsock.Client, error) {
+	options = append(options,
+		qsock.ClientOptionRemote(t.Addr()),
+		qsock.ClientOptionProtocol(qsock.ProtocolTCP),
+	)
+	cli, err := qsock.NewClient(options...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = cli.WriteRaw(t.token); err != nil {
+		cli.Close(err)
+		return nil, err
+	}
+	return cli, nil
+}
+
+func (t *Tunnel) Close() error {
+	if t.owned {
+		_ = t.lb.Close()
+	} else {
+		t.lb.take(string(t.token))
+	}
+	return t.conn.Close()
+}
+
+// pipe 双向转发, 任一方向结束后关闭两端
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+}
@@ -0,0 +1,74 @@
+package gateway
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopback(t *testing.T) {
+	tt := require.New(t)
+
+	lb, err := NewLoopback()
+	tt.NoError(err)
+	defer lb.Close()
+
+	remote, peer := net.Pipe()
+	defer peer.Close()
+	tun, err := lb.Open(remote)
+	tt.NoError(err)
+	tt.Len(tun.Token(), TokenLen)
+
+	// dial 连接回环地址并发送token及数据
+	dial := func(token []byte) net.Conn {
+		local, err := net.Dial("tcp", tun.Addr())
+		tt.NoError(err)
+		_, err = local.Write(append(token, "ping"...))
+		tt.NoError(err)
+		return local
+	}
+	closed := func(local net.Conn) {
+		_ = local.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := local.Read(make([]byte, 1))
+		tt.Error(err)
+		// 未读取的数据使关闭表现为EOF或连接重置, 但不能是超时
+		ne, ok := err.(net.Error)
+		tt.False(ok && ne.Timeout())
+	}
+
+	// 令牌错误的连接被关闭, 数据不会转发到远端
+	local := dial([]byte(strings.Repeat("0", TokenLen)))
+	defer local.Close()
+	closed(local)
+	_ = peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = peer.Read(make([]byte, 1))
+	tt.Error(err)
+	_ = peer.SetReadDeadline(time.Time{})
+
+	// 令牌正确时双向转发
+	local = dial(tun.Token())
+	defer local.Close()
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(peer, buf)
+	tt.NoError(err)
+	tt.Equal("ping", string(buf))
+	_, err = peer.Write([]byte("pong"))
+	tt.NoError(err)
+	_, err = io.ReadFull(local, buf)
+	tt.NoError(err)
+	tt.Equal("pong", string(buf))
+
+	// 令牌只能使用一次
+	again := dial(tun.Token())
+	defer again.Close()
+	closed(again)
+
+	// 关闭后不再创建隧道
+	tt.NoError(lb.Close())
+	_, err = lb.Open(peer)
+	tt.Equal(net.ErrClosed, err)
+}
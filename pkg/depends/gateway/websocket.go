@@ -0,0 +1,171 @@
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/saitofun/qlib/net/qbuf/qbuf_packet"
+	"github.com/saitofun/qlib/net/qbuf/qbuf_stream"
+	"github.com/saitofun/qlib/net/qmsg"
+	"github.com/saitofun/qlib/net/qsock"
+)
+
+// WebSocket WebSocket网关, 每个WebSocket连接对应一条到上游服务的TCP连接, 双向转发协议消息.
+// 下行的每条消息编码为一个WebSocket消息; 上行的消息可携带一个或多个协议帧, 帧也可跨消息分片
+type WebSocket struct {
+	parser   qmsg.Parser // parser WebSocket侧协议解析器
+	upstream string
+	codec    qmsg.Parser // codec 上游协议解析器
+	srv      *http.Server
+	upgrader websocket.Upgrader
+}
+
+// TextParser 文本协议解析器, 下行消息以WebSocket文本消息承载
+type TextParser interface {
+	qmsg.Parser
+	Text() bool
+}
+
+// FrameLimiter 限制单帧长度的解析器, 网关以此限制单个WebSocket消息的长度,
+// 超出时在读取完整消息前即断开连接
+type FrameLimiter interface {
+	FrameLimit() int64
+}
+
+// NewWebSocket 创建WebSocket网关, addr为监听地址, path为升级路径, parser为WebSocket侧协议解析器,
+// upstream为上游服务地址, codec为上游协议解析器; 两侧编码可以不同, 网关按消息转换
+func NewWebSocket(addr, path string, parser qmsg.Parser, upstream string, codec qmsg.Parser) *WebSocket {
+	ws := &WebSocket{
+		parser:   parser,
+		upstream: upstream,
+		codec:    codec,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			CheckOrigin:     func(*http.Request) bool { return true },
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, ws.serve)
+	ws.srv = &http.Server{Addr: addr, Handler: mux}
+	return ws
+}
+
+// ListenAndServe 监听并处理WebSocket连接, 直到Close
+func (ws *WebSocket) ListenAndServe() error {
+	err := ws.srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (ws *WebSocket) Close() error { return ws.srv.Close() }
+
+func (ws *WebSocket) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := ws.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if p, ok := ws.parser.(FrameLimiter); ok {
+		conn.SetReadLimit(p.FrameLimit())
+	}
+
+	cli, err := qsock.NewClient(
+		qsock.ClientOptionParser(ws.codec),
+		qsock.ClientOptionRemote(ws.upstream),
+		qsock.ClientOptionProtocol(qsock.ProtocolTCP),
+		qsock.ClientOptionNodeID(r.RemoteAddr),
+	)
+	if err != nil {
+		_ = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "upstream unavailable"),
+			time.Now().Add(time.Second))
+		return
+	}
+	defer cli.Close("websocket closed")
+
+	b := &bridge{conn: conn, cli: cli, parser: ws.parser, typ: websocket.BinaryMessage, mtx: &sync.Mutex{}}
+	if p, ok := ws.parser.(TextParser); ok && p.Text() {
+		b.typ = websocket.TextMessage
+	}
+	go b.downstream()
+	b.upstream()
+}
+
+// bridge 一个WebSocket连接与其上游连接的转发
+type bridge struct {
+	conn   *websocket.Conn
+	cli    *qsock.Client
+	parser qmsg.Parser
+	typ    int         // typ 下行WebSocket消息类型
+	mtx    *sync.Mutex // mtx WebSocket连接不支持并发写
+}
+
+// upstream 解析WebSocket消息中的协议帧并转发到上游;
+// 解析器以error形式返回的消息(如畸形帧)直接应答浏览器后断开
+func (b *bridge) upstream() {
+	buf := qbuf_stream.New(4096)
+	for {
+		typ, dat, err := b.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if typ != websocket.BinaryMessage && typ != websocket.TextMessage {
+			continue
+		}
+		// 文本消息视为完整的一行
+		if typ == websocket.TextMessage && !bytes.HasSuffix(dat, []byte{'\n'}) {
+			dat = append(dat, '\n')
+		}
+		_, _ = buf.Write(dat)
+		for {
+			msg, err := b.parser.Unmarshal(buf)
+			if err != nil {
+				break
+			}
+			if _, ok := msg.(error); ok {
+				b.write(msg)
+				return
+			}
+			if err = b.cli.SendMessage(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// downstream 将上游消息编码为WebSocket二进制消息转发给浏览器
+func (b *bridge) downstream() {
+	defer b.conn.Close()
+
+	for {
+		msg, err := b.cli.RecvMessage()
+		if err != nil {
+			if qsock.IsTimeoutError(err) {
+				continue
+			}
+			return
+		}
+		if msg == nil || !b.write(msg) {
+			return
+		}
+	}
+}
+
+// write 将msg编码为一个WebSocket消息, 连接写失败时返回false
+func (b *bridge) write(msg qmsg.Message) bool {
+	buf := qbuf_packet.New(4096)
+	if err := b.parser.Marshal(buf, msg); err != nil {
+		fmt.Printf("[gateway.websocket] marshal %v: %v\n", msg.Type(), err)
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.conn.WriteMessage(b.typ, buf.Bytes()) == nil
+}
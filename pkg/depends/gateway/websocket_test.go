@@ -0,0 +1,83 @@
+package gateway
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/qlib/net/qbuf/qbuf_stream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocket(t *testing.T) {
+	tt := require.New(t)
+
+	// 上游经本地隧道交给qsock.Client应答握手
+	lb, err := NewLoopback()
+	tt.NoError(err)
+	defer lb.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	tt.NoError(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go welcome(lb, conn)
+		}
+	}()
+
+	gw := httptest.NewServer(NewWebSocket("", "/chat", protoc.Parser, ln.Addr().String(), protoc.Parser).srv.Handler)
+	defer gw.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(gw.URL, "http")+"/chat", nil)
+	tt.NoError(err)
+	defer conn.Close()
+
+	// 协议帧跨WebSocket消息分片发送
+	hello := protoc.NewHello(1, protoc.Version, protoc.Capabilities).Bytes()
+	tt.NoError(conn.WriteMessage(websocket.BinaryMessage, hello[:5]))
+	tt.NoError(conn.WriteMessage(websocket.BinaryMessage, hello[5:]))
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, dat, err := conn.ReadMessage()
+	tt.NoError(err)
+	tt.Equal(websocket.BinaryMessage, typ)
+
+	buf := qbuf_stream.New(len(dat))
+	_, _ = buf.Write(dat)
+	msg, err := protoc.Parser.Unmarshal(buf)
+	tt.NoError(err)
+	tt.Equal(protoc.NewWelcome(1, protoc.Version, protoc.Capabilities, ""), msg)
+	tt.Equal(0, buf.Len())
+
+	// 畸形帧应答协议错误后断开
+	tt.NoError(conn.WriteMessage(websocket.BinaryMessage,
+		(&protoc.Header{Seq: 2, Type: protoc.CmdEcho, Len: 1 << 31}).Bytes()))
+	_, dat, err = conn.ReadMessage()
+	tt.NoError(err)
+	buf = qbuf_stream.New(len(dat))
+	_, _ = buf.Write(dat)
+	msg, err = protoc.Parser.Unmarshal(buf)
+	tt.NoError(err)
+	tt.IsType(&protoc.ProtocolError{}, msg)
+	_, _, err = conn.ReadMessage()
+	tt.Error(err)
+
+	// 超过单帧最大长度的WebSocket消息不缓存, 直接断开
+	conn, _, err = websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(gw.URL, "http")+"/chat", nil)
+	tt.NoError(err)
+	defer conn.Close()
+	tt.NoError(conn.WriteMessage(websocket.BinaryMessage, make([]byte, protoc.DefaultMaxFrameSize+protoc.HeaderLen+1)))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	tt.True(websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+}
@@ -0,0 +1,39 @@
+package protoc
+
+import (
+	"errors"
+	"strings"
+)
+
+var errInvalidCredentialArg = errors.New("CHAT:invalid credential argument")
+
+// CredentialArg 注册/登录指令参数: `用户名 密码`, 用户名及密码均不含空白
+func CredentialArg(name, password string) string {
+	return strings.TrimSpace(name + " " + password)
+}
+
+// ParseCredentialArg 解析注册/登录指令参数, 省略密码时按空密码校验
+func ParseCredentialArg(arg string) (name, password string, err error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", "", errInvalidCredentialArg
+	}
+	if len(fields) == 2 {
+		password = fields[1]
+	}
+	return fields[0], password, nil
+}
+
+// PasswdArg 修改密码指令参数: `旧密码 新密码`
+func PasswdArg(old, password string) string {
+	return strings.TrimSpace(old + " " + password)
+}
+
+// ParsePasswdArg 解析修改密码指令参数
+func ParsePasswdArg(arg string) (old, password string, err error) {
+	fields := strings.Fields(arg)
+	if len(fields) != 2 {
+		return "", "", errInvalidCredentialArg
+	}
+	return fields[0], fields[1], nil
+}
@@ -0,0 +1,130 @@
+package protoc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saitofun/qlib/net/qmsg"
+)
+
+// Direct srv -> cli 用户私信, 推送给收件人的全部连接及发件人的其他连接
+type Direct struct {
+	Header
+	From string
+	To   string
+	Body string
+	Time int64 // Time 服务端发送时间(毫秒)
+}
+
+var _ qmsg.Message = (*Direct)(nil)
+
+func (m *Direct) Type() qmsg.Type { return CmdDirect }
+
+func (m *Direct) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	buf.Write(m.Header.Bytes())
+	buf.Write(BinaryText(m.From))
+	buf.Write(BinaryText(m.To))
+	buf.Write(BinaryText(m.Body))
+	buf.Write(BinaryUint64(uint64(m.Time)))
+
+	return buf.Bytes()
+}
+
+func (m Direct) Marshal() ([]byte, error) { return m.Bytes(), nil }
+
+func (m *Direct) Unmarshal(dat []byte) error {
+	if err := m.Header.Unmarshal(dat); err != nil {
+		return err
+	}
+	dat = dat[12:]
+	if uint32(len(dat)) != m.Len {
+		return errUnexpectedPayloadLength
+	}
+
+	offset := uint32(0)
+	for _, v := range []*string{&m.From, &m.To, &m.Body} {
+		str, delta, err := ParseString(dat[offset:])
+		if err != nil {
+			return err
+		}
+		*v, offset = str, offset+delta
+	}
+	if uint32(len(dat)) != offset+8 {
+		return errUnexpectedPayloadLength
+	}
+	m.Time = int64(order.Uint64(dat[offset:]))
+	return nil
+}
+
+// SentAt 服务端发送时间
+func (m *Direct) SentAt() time.Time { return time.UnixMilli(m.Time) }
+
+// Echo 以回显消息表示的私信, 用于未协商CapDirect的连接
+func (m *Direct) Echo() *Echo { return NewEcho(m.Seq, m.From, "[私信 -> "+m.To+"] "+m.Body) }
+
+func (m *Direct) String() string {
+	return fmt.Sprintf("%s [私信] %s -> %s: %s", m.SentAt().Format("15:04:05"), m.From, m.To, m.Body)
+}
+
+func NewDirect(seq Seq, from, to, body string, t time.Time) *Direct {
+	return &Direct{
+		Header: Header{
+			Seq:  seq,
+			Type: CmdDirect,
+			Len:  uint32(20 + len(from) + len(to) + len(body)),
+		},
+		From: from,
+		To:   to,
+		Body: body,
+		Time: t.UnixMilli(),
+	}
+}
+
+func BinaryUint64(v uint64) []byte {
+	ret := make([]byte, 8)
+	order.PutUint64(ret, v)
+	return ret
+}
+
+var (
+	errInvalidDirectArg = errors.New("CHAT:invalid direct message argument")
+	errInvalidInboxArg  = errors.New("CHAT:invalid inbox argument")
+)
+
+// DirectArg 私信指令参数: `收件人 内容`
+func DirectArg(to, body string) string { return to + " " + body }
+
+// ParseDirectArg 解析私信指令参数, 收件人及内容均不能为空
+func ParseDirectArg(arg string) (to, body string, err error) {
+	arg = strings.TrimSpace(arg)
+	idx := strings.IndexFunc(arg, func(r rune) bool { return r == ' ' || r == '\t' })
+	if idx <= 0 {
+		return "", "", errInvalidDirectArg
+	}
+	to, body = arg[:idx], strings.TrimSpace(arg[idx+1:])
+	if body == "" {
+		return "", "", errInvalidDirectArg
+	}
+	return to, body, nil
+}
+
+// InboxArg 信箱指令参数: `[序号]`, 从该序号开始按存入顺序列出, 序号从0开始
+func InboxArg(offset int) string { return strconv.Itoa(offset) }
+
+// ParseInboxArg 解析信箱指令参数, 省略时为0
+func ParseInboxArg(arg string) (offset int, err error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return 0, nil
+	}
+	if offset, err = strconv.Atoi(arg); err != nil || offset < 0 {
+		return 0, errInvalidInboxArg
+	}
+	return offset, nil
+}
@@ -0,0 +1,220 @@
+package protoc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/saitofun/qlib/net/qmsg"
+)
+
+const (
+	Magic      uint32 = 0x43484154 // Magic "CHAT"
+	Version    uint32 = 1          // Version 当前协议版本
+	MinVersion uint32 = 1          // MinVersion 可兼容的最低协议版本
+)
+
+// Capability 能力位图
+type Capability uint32
+
+const (
+	CapEcho      Capability = 1 << iota // CapEcho 房间聊天
+	CapInstruct                         // CapInstruct GM指令
+	CapResponse                         // CapResponse 结构化指令应答, 否则以SYSTEM回显消息应答
+	CapHeartbeat                        // CapHeartbeat 应答服务端心跳, 超时未应答的连接将被回收
+	CapNotice                           // CapNotice 接收服务端通知, 否则以SYSTEM回显消息推送
+	CapMessageID                        // CapMessageID 房间消息携带服务端分配的消息ID和时间戳
+	CapDirect                           // CapDirect 以DIRECT帧接收私信, 否则以回显消息推送
+	CapMention                          // CapMention 房间消息携带@提及的用户列表, 需同时协商CapMessageID
+)
+
+const (
+	// CapRequired 双方必须同时支持的能力
+	CapRequired = CapEcho | CapInstruct
+	// Capabilities 当前实现支持的全部能力
+	Capabilities = CapEcho | CapInstruct | CapResponse | CapHeartbeat | CapNotice | CapMessageID | CapDirect | CapMention
+)
+
+func (c Capability) Has(v Capability) bool { return c&v == v }
+
+func (c Capability) Uint32() uint32 { return uint32(c) }
+
+func (c Capability) String() string {
+	names := make([]string, 0)
+	for _, v := range []Capability{CapEcho, CapInstruct, CapResponse, CapHeartbeat, CapNotice, CapMessageID, CapDirect, CapMention} {
+		if c.Has(v) {
+			names = append(names, capabilityNames[v])
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+var capabilityNames = map[Capability]string{
+	CapEcho:      "ECHO",
+	CapInstruct:  "INSTRUCT",
+	CapResponse:  "RESPONSE",
+	CapHeartbeat: "HEARTBEAT",
+	CapNotice:    "NOTICE",
+	CapMessageID: "MESSAGE_ID",
+	CapDirect:    "DIRECT",
+	CapMention:   "MENTION",
+}
+
+// Hello cli -> srv 握手请求, 连接建立后必须首先发送
+type Hello struct {
+	Header
+	Magic   uint32
+	Version uint32
+	Caps    Capability
+}
+
+var _ qmsg.Message = (*Hello)(nil)
+
+func (m *Hello) Type() qmsg.Type { return CmdHello }
+
+func (m *Hello) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	buf.Write(m.Header.Bytes())
+	buf.Write(BinaryUint32(m.Magic))
+	buf.Write(BinaryUint32(m.Version))
+	buf.Write(BinaryUint32(m.Caps.Uint32()))
+
+	return buf.Bytes()
+}
+
+func (m Hello) Marshal() ([]byte, error) { return m.Bytes(), nil }
+
+func (m *Hello) Unmarshal(dat []byte) error {
+	if err := m.Header.Unmarshal(dat); err != nil {
+		return err
+	}
+	dat = dat[12:]
+	if uint32(len(dat)) != m.Len || m.Len != 12 {
+		return errUnexpectedPayloadLength
+	}
+	m.Magic = order.Uint32(dat[0:4])
+	m.Version = order.Uint32(dat[4:8])
+	m.Caps = Capability(order.Uint32(dat[8:12]))
+	return nil
+}
+
+func (m *Hello) String() string {
+	return fmt.Sprintf("HELLO v%d %s", m.Version, m.Caps)
+}
+
+func NewHello(seq Seq, version uint32, caps Capability) *Hello {
+	return &Hello{
+		Header: Header{
+			Seq:  seq,
+			Type: CmdHello,
+			Len:  12,
+		},
+		Magic:   Magic,
+		Version: version,
+		Caps:    caps,
+	}
+}
+
+// Welcome srv -> cli 握手应答, Reason非空表示握手被拒绝
+type Welcome struct {
+	Header
+	Version uint32
+	Caps    Capability
+	Reason  string
+}
+
+var _ qmsg.Message = (*Welcome)(nil)
+
+func (m *Welcome) Type() qmsg.Type { return CmdWelcome }
+
+func (m *Welcome) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	buf.Write(m.Header.Bytes())
+	buf.Write(BinaryUint32(m.Version))
+	buf.Write(BinaryUint32(m.Caps.Uint32()))
+	buf.Write(BinaryText(m.Reason))
+
+	return buf.Bytes()
+}
+
+func (m Welcome) Marshal() ([]byte, error) { return m.Bytes(), nil }
+
+func (m *Welcome) Unmarshal(dat []byte) error {
+	if err := m.Header.Unmarshal(dat); err != nil {
+		return err
+	}
+	dat = dat[12:]
+	if uint32(len(dat)) != m.Len {
+		return errUnexpectedPayloadLength
+	}
+	if len(dat) < 8 {
+		return errDataLack
+	}
+	m.Version = order.Uint32(dat[0:4])
+	m.Caps = Capability(order.Uint32(dat[4:8]))
+	str, delta, err := ParseString(dat[8:])
+	if err != nil {
+		return err
+	}
+	if 8+delta != m.Len {
+		return errUnexpectedPayloadLength
+	}
+	m.Reason = str
+	return nil
+}
+
+// Accepted 握手是否成功
+func (m *Welcome) Accepted() bool { return m.Reason == "" }
+
+func (m *Welcome) String() string {
+	if !m.Accepted() {
+		return "[SERVER] 握手失败: " + m.Reason
+	}
+	return fmt.Sprintf("WELCOME v%d %s", m.Version, m.Caps)
+}
+
+func NewWelcome(seq Seq, version uint32, caps Capability, reason string) *Welcome {
+	return &Welcome{
+		Header: Header{
+			Seq:  seq,
+			Type: CmdWelcome,
+			Len:  uint32(12 + len(reason)),
+		},
+		Version: version,
+		Caps:    caps,
+		Reason:  reason,
+	}
+}
+
+// Negotiate 根据对端Hello协商双方共同的协议版本和能力集
+func Negotiate(hello *Hello, version uint32, caps Capability) (uint32, Capability, error) {
+	if hello.Magic != Magic {
+		return 0, 0, ErrBadMagic
+	}
+	if hello.Version < MinVersion {
+		return 0, 0, ErrVersionUnsupported
+	}
+	if hello.Version < version {
+		version = hello.Version
+	}
+	caps &= hello.Caps
+	if !caps.Has(CapRequired) {
+		return 0, 0, ErrCapabilityMismatch
+	}
+	return version, caps, nil
+}
+
+func BinaryUint32(v uint32) []byte {
+	ret := make([]byte, 4)
+	order.PutUint32(ret, v)
+	return ret
+}
+
+var (
+	ErrBadMagic           = errors.New("CHAT:bad magic")
+	ErrVersionUnsupported = errors.New("CHAT:protocol version unsupported")
+	ErrCapabilityMismatch = errors.New("CHAT:capability mismatch")
+)
@@ -0,0 +1,54 @@
+package protoc_test
+
+import (
+	"testing"
+
+	. "github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/qlib/net/qbuf/qbuf_stream"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiate(t *testing.T) {
+	hello := func(magic, version uint32, caps Capability) *Hello {
+		msg := NewHello(1, version, caps)
+		msg.Magic = magic
+		return msg
+	}
+
+	cases := []struct {
+		name    string
+		hello   *Hello
+		local   uint32 // local 本端协议版本
+		version uint32
+		caps    Capability
+		err     error
+	}{
+		{"Match", hello(Magic, Version, Capabilities), Version, Version, Capabilities, nil},
+		{"BadMagic", hello(0x48545450, Version, Capabilities), Version, 0, 0, ErrBadMagic},
+		{"Unsupported", hello(Magic, MinVersion-1, Capabilities), Version, 0, 0, ErrVersionUnsupported},
+		{"PeerOlder", hello(Magic, 2, Capabilities), 3, 2, Capabilities, nil},
+		{"PeerNewer", hello(Magic, 3, Capabilities), 2, 2, Capabilities, nil},
+		{"Intersect", hello(Magic, Version, CapEcho|CapInstruct|CapNotice|1<<30), Version, Version,
+			CapEcho | CapInstruct | CapNotice, nil},
+		{"MissingRequired", hello(Magic, Version, CapEcho|CapNotice), Version, 0, 0, ErrCapabilityMismatch},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			tt := require.New(t)
+
+			// 经解析器编解码后协商, 与服务端收到的HELLO一致
+			w, r := qbuf_stream.New(64), qbuf_stream.New(64)
+			tt.NoError(Parser.Marshal(w, c.hello))
+			_, _ = r.Write(w.Bytes())
+			msg, err := Parser.Unmarshal(r)
+			tt.NoError(err)
+			tt.Equal(c.hello, msg)
+
+			version, caps, err := Negotiate(msg.(*Hello), c.local, Capabilities)
+			tt.Equal(c.err, err)
+			tt.Equal(c.version, version)
+			tt.Equal(c.caps, caps)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package protoc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/saitofun/qlib/net/qmsg"
+)
+
+// Ping srv <-> cli 心跳请求, Time为发送方时间戳(纳秒)
+type Ping struct {
+	Header
+	Time int64
+}
+
+var _ qmsg.Message = (*Ping)(nil)
+
+func (m *Ping) Type() qmsg.Type { return CmdPing }
+
+func (m *Ping) Bytes() []byte { return heartbeatBytes(&m.Header, m.Time) }
+
+func (m Ping) Marshal() ([]byte, error) { return m.Bytes(), nil }
+
+func (m *Ping) Unmarshal(dat []byte) (err error) {
+	m.Time, err = parseHeartbeat(&m.Header, dat)
+	return err
+}
+
+func (m *Ping) String() string { return fmt.Sprintf("PING %d", m.Time) }
+
+func NewPing(seq Seq) *Ping {
+	return &Ping{
+		Header: Header{Seq: seq, Type: CmdPing, Len: 8},
+		Time:   time.Now().UnixNano(),
+	}
+}
+
+// Pong srv <-> cli 心跳应答, Seq和Time与对应的Ping一致
+type Pong struct {
+	Header
+	Time int64
+}
+
+var _ qmsg.Message = (*Pong)(nil)
+
+func (m *Pong) Type() qmsg.Type { return CmdPong }
+
+func (m *Pong) Bytes() []byte { return heartbeatBytes(&m.Header, m.Time) }
+
+func (m Pong) Marshal() ([]byte, error) { return m.Bytes(), nil }
+
+func (m *Pong) Unmarshal(dat []byte) (err error) {
+	m.Time, err = parseHeartbeat(&m.Header, dat)
+	return err
+}
+
+// RTT 往返时延
+func (m *Pong) RTT() time.Duration { return time.Since(time.Unix(0, m.Time)) }
+
+func (m *Pong) String() string { return fmt.Sprintf("PONG %d", m.Time) }
+
+func NewPong(ping *Ping) *Pong {
+	return &Pong{
+		Header: Header{Seq: ping.Seq, Type: CmdPong, Len: 8},
+		Time:   ping.Time,
+	}
+}
+
+func heartbeatBytes(h *Header, t int64) []byte {
+	buf := bytes.NewBuffer(nil)
+
+	buf.Write(h.Bytes())
+	binary.Write(buf, order, t)
+
+	return buf.Bytes()
+}
+
+func parseHeartbeat(h *Header, dat []byte) (int64, error) {
+	if err := h.Unmarshal(dat); err != nil {
+		return 0, err
+	}
+	dat = dat[12:]
+	if uint32(len(dat)) != h.Len || h.Len != 8 {
+		return 0, errUnexpectedPayloadLength
+	}
+	return int64(order.Uint64(dat[0:8])), nil
+}
@@ -0,0 +1,40 @@
+package protoc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errInvalidHistoryArg = errors.New("CHAT:invalid history argument")
+
+// HistoryArg 历史消息指令参数: `[房间名或房间号] [消息ID] [条数]`, 房间为空或0表示当前房间,
+// 消息ID为0表示从最新消息开始, 条数为0使用服务端默认值
+func HistoryArg(room string, before uint64, limit int) string {
+	if room == "" {
+		room = "0"
+	}
+	return room + " " + strconv.FormatUint(before, 10) + " " + strconv.Itoa(limit)
+}
+
+// ParseHistoryArg 解析历史消息指令参数, 省略的房间及当前房间为空, 省略的其他参数为0
+func ParseHistoryArg(arg string) (room string, before uint64, limit int, err error) {
+	fields := strings.Fields(arg)
+	if len(fields) > 3 {
+		return "", 0, 0, errInvalidHistoryArg
+	}
+	if len(fields) > 0 && fields[0] != "0" {
+		room = fields[0]
+	}
+	if len(fields) > 1 {
+		if before, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return "", 0, 0, errInvalidHistoryArg
+		}
+	}
+	if len(fields) > 2 {
+		if limit, err = strconv.Atoi(fields[2]); err != nil || limit < 0 {
+			return "", 0, 0, errInvalidHistoryArg
+		}
+	}
+	return room, before, limit, nil
+}
@@ -0,0 +1,230 @@
+package protoc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/saitofun/qlib/net/qbuf"
+	"github.com/saitofun/qlib/net/qmsg"
+)
+
+// frame JSON文本协议帧, 每行一个JSON对象.
+// body: Echo及Direct消息内容/Instruct参数/Welcome及ProtocolError原因/Notice内容; kind: Response载荷类型/Notice类型;
+// payload: Response载荷; id: Echo消息ID; mentions: Echo提及的用户; to: Direct收件人; time: Echo发布及Direct发送时间(毫秒)/心跳时间戳(纳秒)
+type frame struct {
+	Seq      Seq             `json:"seq"`
+	Type     string          `json:"type"`
+	Cmd      string          `json:"cmd,omitempty"`
+	From     string          `json:"from,omitempty"`
+	Body     string          `json:"body,omitempty"`
+	Version  uint32          `json:"version,omitempty"`
+	Caps     Capability      `json:"caps,omitempty"`
+	Code     uint32          `json:"code,omitempty"`
+	Kind     string          `json:"kind,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	Time     int64           `json:"time,omitempty"`
+	ID       uint64          `json:"id,omitempty"`
+	To       string          `json:"to,omitempty"`
+	Mentions []string        `json:"mentions,omitempty"`
+}
+
+type jsonParser struct {
+	max uint32 // max 单行最大长度
+}
+
+var JSONParser = NewJSONParser(DefaultMaxFrameSize)
+
+// NewJSONParser 创建按行分隔的JSON文本协议解析器, 与二进制协议承载相同的消息, 便于调试和脚本语言接入
+func NewJSONParser(max uint32) qmsg.Parser { return &jsonParser{max: max} }
+
+// Text 文本协议, 网关以WebSocket文本消息承载
+func (p jsonParser) Text() bool { return true }
+
+// FrameLimit 单帧最大字节数(含换行符)
+func (p jsonParser) FrameLimit() int64 { return int64(p.max) + 1 }
+
+func (p jsonParser) Marshal(buf qbuf.Buffer, msg qmsg.Message) error {
+	f := &frame{}
+
+	switch m := msg.(type) {
+	case *Echo:
+		f.Seq, f.From, f.Body, f.ID = m.Seq, m.From, m.Body, m.MsgID
+		if m.MsgID != 0 {
+			f.Time, f.Mentions = m.Time, m.Mentions
+		}
+	case *Instruct:
+		f.Seq, f.Cmd, f.Body = m.Seq, m.GmCmd.String(), m.Arg
+	case *Hello:
+		f.Seq, f.Version, f.Caps = m.Seq, m.Version, m.Caps
+	case *Welcome:
+		f.Seq, f.Version, f.Caps, f.Body = m.Seq, m.Version, m.Caps, m.Reason
+	case *Response:
+		f.Seq, f.Code, f.Kind, f.Payload = m.Seq, m.Code, m.Kind.String(), m.Body
+	case *Ping:
+		f.Seq, f.Time = m.Seq, m.Time
+	case *Pong:
+		f.Seq, f.Time = m.Seq, m.Time
+	case *ProtocolError:
+		f.Seq, f.Body = m.Seq, m.Reason
+	case *Notice:
+		f.Seq, f.Kind, f.Body = m.Seq, m.Kind.String(), m.Body
+	case *Direct:
+		f.Seq, f.From, f.To, f.Body, f.Time = m.Seq, m.From, m.To, m.Body, m.Time
+	default:
+		return errUnknownMessage
+	}
+	f.Type = msg.Type().String()
+
+	dat, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	buf.Reset()
+	_, err = buf.Write(append(dat, '\n'))
+	return err
+}
+
+// Unmarshal 解析一行JSON消息, 空行忽略; 畸形帧的处理与二进制协议一致
+func (p jsonParser) Unmarshal(buf qbuf.Buffer) (qmsg.Message, error) {
+	for {
+		dat, err := buf.Probe(buf.Len())
+		if err != nil {
+			return nil, err
+		}
+		idx := bytes.IndexByte(dat, '\n')
+		if idx < 0 {
+			if uint32(len(dat)) > p.max {
+				buf.Reset()
+				return NewLocalProtocolError(0, ErrFrameTooLarge), nil
+			}
+			return nil, qbuf.EStreamBufferDataLack
+		}
+		if uint32(idx) > p.max {
+			buf.Reset()
+			return NewLocalProtocolError(0, ErrFrameTooLarge), nil
+		}
+		_ = buf.Shift(idx + 1)
+
+		line := bytes.TrimSpace(dat[:idx])
+		if len(line) == 0 {
+			continue
+		}
+		f := &frame{}
+		if err = json.Unmarshal(line, f); err != nil {
+			buf.Reset()
+			return NewLocalProtocolError(0, errMalformedJSON), nil
+		}
+		msg, err := f.message()
+		if err != nil {
+			buf.Reset()
+			return NewLocalProtocolError(f.Seq, err), nil
+		}
+		return msg, nil
+	}
+}
+
+func (f *frame) message() (qmsg.Message, error) {
+	switch ParseType(f.Type) {
+	case CmdEcho:
+		msg := NewEcho(f.Seq, f.From, f.Body)
+		if f.ID != 0 {
+			msg.SetMeta(f.ID, time.UnixMilli(f.Time))
+			if len(f.Mentions) > 0 {
+				msg.SetMentions(f.Mentions)
+			}
+		}
+		return msg, nil
+	case CmdInstruct:
+		cmd := ParseGmCmd(f.Cmd)
+		if cmd == GmCmdUnknown {
+			return nil, errUnknownMessage
+		}
+		return NewInstruct(f.Seq, cmd, f.Body), nil
+	case CmdHello:
+		return NewHello(f.Seq, f.Version, f.Caps), nil
+	case CmdWelcome:
+		return NewWelcome(f.Seq, f.Version, f.Caps, f.Body), nil
+	case CmdResponse:
+		return &Response{
+			Header: Header{
+				Seq:  f.Seq,
+				Type: CmdResponse,
+				Len:  uint32(12 + len(f.Payload)),
+			},
+			Code: f.Code,
+			Kind: ParsePayloadKind(f.Kind),
+			Body: []byte(f.Payload),
+		}, nil
+	case CmdPing:
+		ping := NewPing(f.Seq)
+		ping.Time = f.Time
+		return ping, nil
+	case CmdPong:
+		return NewPong(&Ping{Header: Header{Seq: f.Seq}, Time: f.Time}), nil
+	case CmdProtocolError:
+		return NewProtocolError(f.Seq, f.Body), nil
+	case CmdNotice:
+		return NewNotice(f.Seq, ParseNoticeKind(f.Kind), f.Body), nil
+	case CmdDirect:
+		return NewDirect(f.Seq, f.From, f.To, f.Body, time.UnixMilli(f.Time)), nil
+	default:
+		return nil, errUnknownMessage
+	}
+}
+
+// ParseType 根据名称解析消息类型, 大小写不敏感
+func ParseType(name string) Type {
+	for t := CmdEcho; t.String() != ""; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t
+		}
+	}
+	return CmdUnknown
+}
+
+// ParseGmCmd 根据名称解析GM指令, 可省略前缀`/`
+func ParseGmCmd(name string) GmCmd {
+	name = "/" + strings.TrimPrefix(name, "/")
+	for gm := GmCreateUser; gm.String() != ""; gm++ {
+		if gm.String() == name {
+			return gm
+		}
+	}
+	return GmCmdUnknown
+}
+
+// ParsePayloadKind 根据名称解析应答载荷类型
+func ParsePayloadKind(name string) PayloadKind {
+	for k := PayloadNone; k.String() != ""; k++ {
+		if strings.EqualFold(k.String(), name) {
+			return k
+		}
+	}
+	return PayloadNone
+}
+
+const (
+	CodecBinary = "binary" // CodecBinary 大端长度前缀的二进制协议
+	CodecJSON   = "json"   // CodecJSON 按行分隔的JSON文本协议
+)
+
+// NewCodecParser 根据编码名称创建解析器
+func NewCodecParser(codec string, max uint32) (qmsg.Parser, error) {
+	switch codec {
+	case CodecBinary:
+		return NewParser(max), nil
+	case CodecJSON:
+		return NewJSONParser(max), nil
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
+
+var (
+	errMalformedJSON = errors.New("CHAT:malformed json frame")
+
+	ErrUnknownCodec = errors.New("CHAT:unknown codec")
+)
@@ -0,0 +1,113 @@
+package protoc
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/saitofun/qlib/net/qmsg"
+)
+
+// NoticeKind 通知类型
+type NoticeKind uint32
+
+const (
+	NoticeUnknown      NoticeKind = iota
+	NoticeShutdown                // 服务端即将关闭, 随后断开连接
+	NoticeSessionTaken            // 会话已在其他连接上恢复, 随后断开连接
+	NoticeMention                 // 其他房间或离线期间被@提及
+	NoticeJoin                    // 用户进入当前房间
+	NoticeLeave                   // 用户离开当前房间
+	NoticeTopic                   // 当前房间的话题被修改
+)
+
+func (k NoticeKind) String() string {
+	switch k {
+	case NoticeShutdown:
+		return "SHUTDOWN"
+	case NoticeSessionTaken:
+		return "SESSION_TAKEN"
+	case NoticeMention:
+		return "MENTION"
+	case NoticeJoin:
+		return "JOIN"
+	case NoticeLeave:
+		return "LEAVE"
+	case NoticeTopic:
+		return "TOPIC"
+	default:
+		return ""
+	}
+}
+
+// ParseNoticeKind 根据名称解析通知类型
+func ParseNoticeKind(name string) NoticeKind {
+	for k := NoticeShutdown; k.String() != ""; k++ {
+		if k.String() == name {
+			return k
+		}
+	}
+	return NoticeUnknown
+}
+
+// Notice srv -> cli 服务端主动推送的通知, 不对应任何请求
+type Notice struct {
+	Header
+	Kind NoticeKind
+	Body string
+}
+
+var _ qmsg.Message = (*Notice)(nil)
+
+func (m *Notice) Type() qmsg.Type { return CmdNotice }
+
+func (m *Notice) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	buf.Write(m.Header.Bytes())
+	buf.Write(BinaryUint32(uint32(m.Kind)))
+	buf.Write(BinaryText(m.Body))
+
+	return buf.Bytes()
+}
+
+func (m Notice) Marshal() ([]byte, error) { return m.Bytes(), nil }
+
+func (m *Notice) Unmarshal(dat []byte) error {
+	if err := m.Header.Unmarshal(dat); err != nil {
+		return err
+	}
+	dat = dat[12:]
+	if uint32(len(dat)) != m.Len {
+		return errUnexpectedPayloadLength
+	}
+	if len(dat) < 4 {
+		return errDataLack
+	}
+	m.Kind = NoticeKind(order.Uint32(dat[0:4]))
+	str, delta, err := ParseString(dat[4:])
+	if err != nil {
+		return err
+	}
+	if 4+delta != m.Len {
+		return errUnexpectedPayloadLength
+	}
+	m.Body = str
+	return nil
+}
+
+// Echo 以SYSTEM回显消息推送的通知, 用于未协商CapNotice的连接
+func (m *Notice) Echo() *Echo { return NewEcho(m.Seq, "SYSTEM", "[SERVER] "+m.Body) }
+
+func (m *Notice) String() string { return fmt.Sprintf("[NOTICE %s] %s", m.Kind, m.Body) }
+
+func NewNotice(seq Seq, kind NoticeKind, body string) *Notice {
+	return &Notice{
+		Header: Header{
+			Seq:  seq,
+			Type: CmdNotice,
+			Len:  uint32(8 + len(body)),
+		},
+		Kind: kind,
+		Body: body,
+	}
+}
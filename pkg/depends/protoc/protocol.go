@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/saitofun/qlib/net/qbuf"
 	"github.com/saitofun/qlib/net/qmsg"
@@ -16,9 +17,17 @@ import (
 type Type uint32
 
 const (
-	CmdUnknown  Type = iota
-	CmdEcho          // 回显消息
-	CmdInstruct      // GM指令消息
+	CmdUnknown       Type = iota
+	CmdEcho               // 回显消息
+	CmdInstruct           // GM指令消息
+	CmdHello              // 握手请求
+	CmdWelcome            // 握手应答
+	CmdResponse           // 指令应答
+	CmdPing               // 心跳请求
+	CmdPong               // 心跳应答
+	CmdProtocolError      // 协议错误
+	CmdNotice             // 服务端通知
+	CmdDirect             // 用户私信
 )
 
 func (t Type) String() string {
@@ -27,6 +36,22 @@ func (t Type) String() string {
 		return "ECHO"
 	case CmdInstruct:
 		return "INSTRUCT"
+	case CmdHello:
+		return "HELLO"
+	case CmdWelcome:
+		return "WELCOME"
+	case CmdResponse:
+		return "RESPONSE"
+	case CmdPing:
+		return "PING"
+	case CmdPong:
+		return "PONG"
+	case CmdProtocolError:
+		return "PROTOCOL_ERROR"
+	case CmdNotice:
+		return "NOTICE"
+	case CmdDirect:
+		return "DIRECT"
 	default:
 		return ""
 	}
@@ -73,8 +98,11 @@ func (h *Header) Unmarshal(d []byte) error {
 // Echo srv <-> cli
 type Echo struct {
 	Header
-	From string
-	Body string
+	From     string
+	Body     string
+	MsgID    uint64   // MsgID 服务端分配的房间内消息ID, 从1递增; 0表示未分配, 此时不编码MsgID、Time和Mentions
+	Time     int64    // Time 服务端发布时间(毫秒)
+	Mentions []string // Mentions 消息中@提及的用户, 编码在MsgID和Time之后, 为空时不编码
 }
 
 var _ qmsg.Message = (*Echo)(nil)
@@ -87,6 +115,16 @@ func (m *Echo) Bytes() []byte {
 	buf.Write(m.Header.Bytes())
 	buf.Write(BinaryText(m.From))
 	buf.Write(BinaryText(m.Body))
+	if m.MsgID != 0 {
+		binary.Write(buf, order, m.MsgID)
+		binary.Write(buf, order, m.Time)
+		if len(m.Mentions) > 0 {
+			buf.Write(BinaryUint32(uint32(len(m.Mentions))))
+			for _, name := range m.Mentions {
+				buf.Write(BinaryText(name))
+			}
+		}
+	}
 
 	return buf.Bytes()
 }
@@ -99,6 +137,9 @@ func (m *Echo) Unmarshal(dat []byte) error {
 		return err
 	}
 	offset += 12
+	if uint32(len(dat[offset:])) != m.Len {
+		return errUnexpectedPayloadLength
+	}
 
 	str, delta, err := ParseString(dat[offset:])
 	if err != nil {
@@ -114,21 +155,111 @@ func (m *Echo) Unmarshal(dat []byte) error {
 	offset += delta
 	m.Body = str
 
+	if uint32(len(dat)) >= offset+16 {
+		m.MsgID = order.Uint64(dat[offset : offset+8])
+		m.Time = int64(order.Uint64(dat[offset+8 : offset+16]))
+		if m.MsgID == 0 {
+			return errUnexpectedPayloadLength
+		}
+		offset += 16
+	}
+	if uint32(len(dat)) > offset {
+		if m.MsgID == 0 || uint32(len(dat)) < offset+4 {
+			return errUnexpectedPayloadLength
+		}
+		count := order.Uint32(dat[offset : offset+4])
+		offset += 4
+		if count == 0 || count > uint32(len(dat))-offset {
+			return errUnexpectedPayloadLength
+		}
+		m.Mentions = make([]string, 0, count)
+		for i := uint32(0); i < count; i++ {
+			str, delta, err := ParseString(dat[offset:])
+			if err != nil {
+				return err
+			}
+			offset += delta
+			m.Mentions = append(m.Mentions, str)
+		}
+	}
+	if offset != uint32(len(dat)) {
+		return errUnexpectedPayloadLength
+	}
 	return nil
 }
 
 func (m *Echo) SetFrom(from string) {
 	m.From = from
-	m.Len = uint32(len(m.From) + len(m.Body) + 8)
+	m.Len = m.size()
 }
 
 func (m *Echo) SetBody(body string) {
 	m.Body = body
-	m.Len = uint32(len(m.From) + len(m.Body) + 8)
+	m.Len = m.size()
+}
+
+// SetMeta 设置服务端分配的消息ID和发布时间
+func (m *Echo) SetMeta(id uint64, t time.Time) {
+	m.MsgID, m.Time = id, t.UnixMilli()
+	m.Len = m.size()
+}
+
+// WithoutMeta 不携带消息ID、时间戳及提及用户的副本, 用于未协商CapMessageID的连接
+func (m *Echo) WithoutMeta() *Echo {
+	if m.MsgID == 0 {
+		return m
+	}
+	return NewEcho(m.Seq, m.From, m.Body)
+}
+
+// SetMentions 设置消息中@提及的用户
+func (m *Echo) SetMentions(names []string) {
+	m.Mentions = names
+	m.Len = m.size()
+}
+
+// WithoutMentions 不携带提及用户的副本, 用于未协商CapMention的连接
+func (m *Echo) WithoutMentions() *Echo {
+	if len(m.Mentions) == 0 {
+		return m
+	}
+	cp := *m
+	cp.SetMentions(nil)
+	return &cp
+}
+
+// Mentioned 消息是否提及用户name
+func (m *Echo) Mentioned(name string) bool {
+	for _, v := range m.Mentions {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PubAt 服务端发布时间
+func (m *Echo) PubAt() time.Time { return time.UnixMilli(m.Time) }
+
+func (m *Echo) size() uint32 {
+	size := uint32(8 + len(m.From) + len(m.Body))
+	if m.MsgID != 0 {
+		size += 16
+		if len(m.Mentions) > 0 {
+			size += 4
+			for _, name := range m.Mentions {
+				size += uint32(4 + len(name))
+			}
+		}
+	}
+	return size
 }
 
 func (m *Echo) String() string {
-	return fmt.Sprintf("[%s]: %s", m.From, m.Body)
+	if m.MsgID == 0 {
+		return fmt.Sprintf("[%s]: %s", m.From, m.Body)
+	}
+	return fmt.Sprintf("#%d %s [%s]: %s", m.MsgID, m.PubAt().Format("15:04:05"), m.From, m.Body)
 }
 
 func NewEcho(seq Seq, from, body string) *Echo {
@@ -187,6 +318,10 @@ func (m *Instruct) Unmarshal(dat []byte) error {
 	}
 	offset += delta
 	m.Arg = str
+
+	if offset != uint32(len(dat)) {
+		return errUnexpectedPayloadLength
+	}
 	return nil
 }
 
@@ -218,6 +353,15 @@ const (
 	GmEnterRoom
 	GmStats
 	GmPopular
+	GmHistory
+	GmPasswd
+	GmResume
+	GmLogout
+	GmDirect
+	GmInbox
+	GmWho
+	GmCreateRoom
+	GmTopic
 )
 
 func (gm GmCmd) String() string {
@@ -234,14 +378,46 @@ func (gm GmCmd) String() string {
 		return "/stats"
 	case GmPopular:
 		return "/popular"
+	case GmHistory:
+		return "/history"
+	case GmPasswd:
+		return "/passwd"
+	case GmResume:
+		return "/resume"
+	case GmLogout:
+		return "/logout"
+	case GmDirect:
+		return "/msg"
+	case GmInbox:
+		return "/inbox"
+	case GmWho:
+		return "/who"
+	case GmCreateRoom:
+		return "/create"
+	case GmTopic:
+		return "/topic"
 	default:
 		return ""
 	}
 }
 
-type parser struct{}
+// DefaultMaxFrameSize 默认单帧最大长度(不含消息头)
+const DefaultMaxFrameSize uint32 = 64 * 1024
+
+// HeaderLen 二进制协议消息头长度
+const HeaderLen = 12
+
+type parser struct {
+	max uint32 // max 单帧最大长度(不含消息头)
+}
+
+var Parser = NewParser(DefaultMaxFrameSize)
 
-var Parser qmsg.Parser = &parser{}
+// NewParser 创建二进制协议解析器, 消息体超过max的帧视为协议错误
+func NewParser(max uint32) qmsg.Parser { return &parser{max: max} }
+
+// FrameLimit 单帧最大字节数(含消息头)
+func (p parser) FrameLimit() int64 { return int64(p.max) + HeaderLen }
 
 func (p parser) Marshal(buf qbuf.Buffer, msg qmsg.Message) error {
 	var err error
@@ -253,14 +429,32 @@ func (p parser) Marshal(buf qbuf.Buffer, msg qmsg.Message) error {
 		_, err = buf.Write(_msg.Bytes())
 	case *Instruct:
 		_, err = buf.Write(_msg.Bytes())
+	case *Hello:
+		_, err = buf.Write(_msg.Bytes())
+	case *Welcome:
+		_, err = buf.Write(_msg.Bytes())
+	case *Response:
+		_, err = buf.Write(_msg.Bytes())
+	case *Ping:
+		_, err = buf.Write(_msg.Bytes())
+	case *Pong:
+		_, err = buf.Write(_msg.Bytes())
+	case *ProtocolError:
+		_, err = buf.Write(_msg.Bytes())
+	case *Notice:
+		_, err = buf.Write(_msg.Bytes())
+	case *Direct:
+		_, err = buf.Write(_msg.Bytes())
 	default:
 		err = errUnknownMessage
 	}
 	return err
 }
 
+// Unmarshal 解析一帧消息; 数据不足时返回qbuf.EStreamBufferDataLack等待更多数据,
+// 畸形帧不返回错误, 而是丢弃缓冲区数据并返回本地检测到的ProtocolError交由上层应答并断开连接
 func (p parser) Unmarshal(buf qbuf.Buffer) (qmsg.Message, error) {
-	tmp, err := buf.Probe(12)
+	tmp, err := buf.Probe(HeaderLen)
 	if err != nil {
 		return nil, err
 	}
@@ -269,32 +463,59 @@ func (p parser) Unmarshal(buf qbuf.Buffer) (qmsg.Message, error) {
 	if err = header.Unmarshal(tmp); err != nil {
 		return nil, err
 	}
+	if header.Len > p.max {
+		buf.Reset()
+		return NewLocalProtocolError(header.Seq, ErrFrameTooLarge), nil
+	}
 
-	if _, err = buf.Probe(int(header.Len)); err != nil {
+	if _, err = buf.Probe(int(header.Len) + HeaderLen); err != nil {
 		return nil, err
 	}
 
-	dat := make([]byte, int(header.Len)+12)
+	dat := make([]byte, int(header.Len)+HeaderLen)
 	_, _ = buf.Read(dat)
 
-	var msg qmsg.Message
+	msg, err := p.unmarshal(header.Type, dat)
+	if err != nil {
+		buf.Reset()
+		return NewLocalProtocolError(header.Seq, err), nil
+	}
+	return msg, nil
+}
 
-	switch header.Type {
+func (p parser) unmarshal(t Type, dat []byte) (qmsg.Message, error) {
+	var msg interface {
+		qmsg.Message
+		Unmarshal([]byte) error
+	}
+
+	switch t {
 	case CmdEcho:
-		echo := &Echo{}
-		if err = echo.Unmarshal(dat); err != nil {
-			return nil, err
-		}
-		msg = echo
+		msg = &Echo{}
 	case CmdInstruct:
-		instruct := &Instruct{}
-		if err = instruct.Unmarshal(dat); err != nil {
-			return nil, err
-		}
-		msg = instruct
+		msg = &Instruct{}
+	case CmdHello:
+		msg = &Hello{}
+	case CmdWelcome:
+		msg = &Welcome{}
+	case CmdResponse:
+		msg = &Response{}
+	case CmdPing:
+		msg = &Ping{}
+	case CmdPong:
+		msg = &Pong{}
+	case CmdProtocolError:
+		msg = &ProtocolError{}
+	case CmdNotice:
+		msg = &Notice{}
+	case CmdDirect:
+		msg = &Direct{}
 	default:
 		return nil, errUnknownMessage
 	}
+	if err := msg.Unmarshal(dat); err != nil {
+		return nil, err
+	}
 	return msg, nil
 }
 
@@ -324,4 +545,6 @@ var (
 	errDataLack                = errors.New("CHAT:data lack")
 	errUnexpectedPayloadLength = errors.New("CHAT:unexpected payload length")
 	errUnknownMessage          = errors.New("CHAT:unknown message")
+
+	ErrFrameTooLarge = errors.New("CHAT:frame too large")
 )
@@ -0,0 +1,73 @@
+package protoc
+
+import (
+	"bytes"
+
+	"github.com/saitofun/qlib/net/qmsg"
+)
+
+// ProtocolError srv <-> cli 协议错误, 发送方随后断开连接.
+// 本端解析器检测到畸形帧时同样以ProtocolError(Local为true)向上层投递
+type ProtocolError struct {
+	Header
+	Reason string
+	local  bool
+}
+
+var _ qmsg.Message = (*ProtocolError)(nil)
+
+func (m *ProtocolError) Type() qmsg.Type { return CmdProtocolError }
+
+func (m *ProtocolError) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	buf.Write(m.Header.Bytes())
+	buf.Write(BinaryText(m.Reason))
+
+	return buf.Bytes()
+}
+
+func (m ProtocolError) Marshal() ([]byte, error) { return m.Bytes(), nil }
+
+func (m *ProtocolError) Unmarshal(dat []byte) error {
+	if err := m.Header.Unmarshal(dat); err != nil {
+		return err
+	}
+	dat = dat[12:]
+	if uint32(len(dat)) != m.Len {
+		return errUnexpectedPayloadLength
+	}
+	str, delta, err := ParseString(dat)
+	if err != nil {
+		return err
+	}
+	if delta != m.Len {
+		return errUnexpectedPayloadLength
+	}
+	m.Reason = str
+	return nil
+}
+
+// Local 是否为本端解析器检测到的协议错误, 否则为对端发送的错误报告
+func (m *ProtocolError) Local() bool { return m.local }
+
+func (m *ProtocolError) Error() string { return m.Reason }
+
+func (m *ProtocolError) String() string { return "[PROTOCOL ERROR] " + m.Reason }
+
+func NewProtocolError(seq Seq, reason string) *ProtocolError {
+	return &ProtocolError{
+		Header: Header{
+			Seq:  seq,
+			Type: CmdProtocolError,
+			Len:  uint32(4 + len(reason)),
+		},
+		Reason: reason,
+	}
+}
+
+func NewLocalProtocolError(seq Seq, err error) *ProtocolError {
+	ret := NewProtocolError(seq, err.Error())
+	ret.local = true
+	return ret
+}
@@ -0,0 +1,57 @@
+package protoc_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/qlib/net/qbuf"
+	"github.com/saitofun/qlib/net/qbuf/qbuf_stream"
+)
+
+// FuzzParser 任意输入都不能导致解析器panic, 解析成功的消息重新编码后应与原始帧一致
+func FuzzParser(f *testing.F) {
+	for _, seed := range [][]byte{
+		NewEcho(1, "user", "hello").Bytes(),
+		echoWithMeta(9, "user", "hello", 42).Bytes(),
+		echoWithMentions(11, "user", "hi @bob", 43, "bob").Bytes(),
+		NewInstruct(2, GmEnterRoom, "1").Bytes(),
+		NewHello(3, Version, Capabilities).Bytes(),
+		NewWelcome(4, Version, Capabilities, "rejected").Bytes(),
+		NewResponse(5, 1001, PayloadText, "error").Bytes(),
+		NewPing(6).Bytes(),
+		NewProtocolError(7, "bad frame").Bytes(),
+		NewDirect(10, "alice", "bob", "hi", time.UnixMilli(1700000000000)).Bytes(),
+		(&Header{Seq: 8, Type: CmdEcho, Len: 0xFFFFFFFF}).Bytes(),
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, dat []byte) {
+		parser := NewParser(4096)
+		buf := qbuf_stream.New(len(dat) + 1)
+		_, _ = buf.Write(dat)
+
+		for buf.Len() > 0 {
+			before := buf.Bytes()
+			msg, err := parser.Unmarshal(buf)
+			if err == qbuf.EStreamBufferDataLack {
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if e, ok := msg.(*ProtocolError); ok && e.Local() {
+				return
+			}
+			out := qbuf_stream.New(len(dat) + 1)
+			if err = parser.Marshal(out, msg); err != nil {
+				t.Fatalf("marshal %T: %v", msg, err)
+			}
+			consumed := len(before) - buf.Len()
+			if string(out.Bytes()) != string(before[:consumed]) {
+				t.Fatalf("roundtrip mismatch for %T", msg)
+			}
+		}
+	})
+}
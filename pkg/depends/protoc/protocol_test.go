@@ -0,0 +1,219 @@
+package protoc_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/qlib/net/qbuf/qbuf_stream"
+	"github.com/saitofun/qlib/net/qmsg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParser(t *testing.T) {
+	tt := require.New(t)
+
+	messages := []qmsg.Message{
+		NewEcho(1, "user", "hello"),
+		echoWithMeta(9, "user", "hello", 42),
+		echoWithMentions(11, "user", "hi @bob @carol", 43, "bob", "carol"),
+		NewInstruct(2, GmLogin, "user"),
+		NewHello(3, Version, Capabilities),
+		NewWelcome(4, Version, Capabilities, ""),
+		NewResponse(5, 0, PayloadText, "ok"),
+		NewPing(6),
+		NewProtocolError(7, "bad frame"),
+		NewNotice(8, NoticeShutdown, "server shutting down"),
+		NewDirect(10, "alice", "bob", "hi", time.UnixMilli(1700000000000)),
+	}
+
+	w, r := qbuf_stream.New(1024), qbuf_stream.New(1024)
+	for _, msg := range messages {
+		tt.NoError(Parser.Marshal(w, msg))
+		_, _ = r.Write(w.Bytes())
+	}
+	for _, expect := range messages {
+		msg, err := Parser.Unmarshal(r)
+		tt.NoError(err)
+		tt.Equal(expect, msg)
+	}
+	_, err := Parser.Unmarshal(r)
+	tt.Error(err)
+}
+
+func echoWithMeta(seq Seq, from, body string, id uint64) *Echo {
+	msg := NewEcho(seq, from, body)
+	msg.SetMeta(id, time.UnixMilli(1700000000000))
+	return msg
+}
+
+func echoWithMentions(seq Seq, from, body string, id uint64, mentions ...string) *Echo {
+	msg := echoWithMeta(seq, from, body, id)
+	msg.SetMentions(mentions)
+	return msg
+}
+
+func TestParserMalformed(t *testing.T) {
+	tt := require.New(t)
+
+	oversize := (&Header{Seq: 1, Type: CmdEcho, Len: 1 << 31}).Bytes()
+
+	inconsistent := NewEcho(2, "user", "hello")
+	inconsistent.Len += 4
+
+	trailing := NewEcho(3, "user", "hello").Bytes()
+	trailing = append(trailing, 0, 0, 0, 0)
+	copy(trailing[8:12], BinaryUint32(uint32(len(trailing)-12)))
+
+	unknown := (&Header{Seq: 4, Type: Type(0xFFFF), Len: 0}).Bytes()
+
+	shortHello := NewHello(5, Version, Capabilities).Bytes()[:20]
+	copy(shortHello[8:12], BinaryUint32(8))
+
+	cases := []struct {
+		name string
+		data []byte
+		seq  Seq
+	}{
+		{"FrameTooLarge", oversize, 1},
+		{"StringLengthMismatch", append(inconsistent.Bytes(), 0, 0, 0, 0), 2},
+		{"TrailingBytes", trailing, 3},
+		{"UnknownType", unknown, 4},
+		{"ShortHello", shortHello, 5},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			buf := qbuf_stream.New(1024)
+			_, _ = buf.Write(c.data)
+			msg, err := NewParser(1024).Unmarshal(buf)
+			tt.NoError(err)
+			e, ok := msg.(*ProtocolError)
+			tt.True(ok)
+			tt.True(e.Local())
+			tt.Equal(c.seq, e.Seq)
+			tt.Equal(0, buf.Len())
+		})
+	}
+}
+
+func TestParserDataLack(t *testing.T) {
+	tt := require.New(t)
+
+	dat := NewEcho(1, "user", "hello").Bytes()
+	buf := qbuf_stream.New(1024)
+	for i := range dat[:len(dat)-1] {
+		_, _ = buf.Write(dat[i : i+1])
+		_, err := Parser.Unmarshal(buf)
+		tt.Error(err)
+		tt.Equal(i+1, buf.Len())
+	}
+	_, _ = buf.Write(dat[len(dat)-1:])
+	msg, err := Parser.Unmarshal(buf)
+	tt.NoError(err)
+	tt.Equal(NewEcho(1, "user", "hello"), msg)
+}
+
+func TestJSONParser(t *testing.T) {
+	tt := require.New(t)
+
+	messages := []qmsg.Message{
+		NewEcho(1, "user", "hello"),
+		echoWithMeta(9, "user", "hello", 42),
+		echoWithMentions(11, "user", "hi @bob @carol", 43, "bob", "carol"),
+		NewInstruct(2, GmLogin, "user"),
+		NewHello(3, Version, Capabilities),
+		NewWelcome(4, Version, Capabilities, ""),
+		NewResponse(5, 0, PayloadRoom, map[string]int{"id": 1}),
+		NewPing(6),
+		NewProtocolError(7, "bad frame"),
+		NewNotice(8, NoticeShutdown, "server shutting down"),
+		NewDirect(10, "alice", "bob", "hi", time.UnixMilli(1700000000000)),
+	}
+
+	w, r := qbuf_stream.New(1024), qbuf_stream.New(1024)
+	for _, msg := range messages {
+		tt.NoError(JSONParser.Marshal(w, msg))
+		_, _ = r.Write(w.Bytes())
+	}
+	for _, expect := range messages {
+		msg, err := JSONParser.Unmarshal(r)
+		tt.NoError(err)
+		tt.Equal(expect, msg)
+	}
+
+	// 手工输入的文本行
+	_, _ = r.Write([]byte("\r\n{\"seq\":8,\"type\":\"instruct\",\"cmd\":\"reg\",\"body\":\"user\"}\r\n"))
+	msg, err := JSONParser.Unmarshal(r)
+	tt.NoError(err)
+	tt.Equal(NewInstruct(8, GmCreateUser, "user"), msg)
+
+	_, _ = r.Write([]byte("{\"seq\":9,\"type\":\"echo\""))
+	_, err = JSONParser.Unmarshal(r)
+	tt.Error(err)
+	_, _ = r.Write([]byte(",\"body\":\"hi\"}\n"))
+	msg, err = JSONParser.Unmarshal(r)
+	tt.NoError(err)
+	tt.Equal(NewEcho(9, "", "hi"), msg)
+
+	for _, line := range []string{"not json\n", "{\"type\":\"unknown\"}\n", "{\"type\":\"instruct\",\"cmd\":\"/nope\"}\n"} {
+		_, _ = r.Write([]byte(line))
+		msg, err = JSONParser.Unmarshal(r)
+		tt.NoError(err)
+		tt.IsType(&ProtocolError{}, msg)
+	}
+}
+
+func TestRoomArg(t *testing.T) {
+	tt := require.New(t)
+
+	room, resume, err := ParseRoomArg(RoomArg("3", nil))
+	tt.NoError(err)
+	tt.Equal("3", room)
+	tt.Nil(resume)
+
+	// 续传标记为消息ID, 不同发送者的同一序列号不会混淆
+	msg := NewEcho(1, "bob", "hi")
+	msg.SetMeta(42, time.Now())
+	room, resume, err = ParseRoomArg(RoomArg("lobby", NewResume(msg)))
+	tt.NoError(err)
+	tt.Equal("lobby", room)
+	tt.Equal(uint64(42), resume.MsgID)
+	next := NewEcho(1, "alice", "")
+	next.SetMeta(43, time.Now())
+	tt.True(resume.After(next))
+	tt.False(resume.After(msg))
+
+	for _, arg := range []string{"", " ", "3 x", "3 42 bob"} {
+		_, _, err = ParseRoomArg(arg)
+		tt.Error(err, arg)
+	}
+
+	name, desc, err := ParseCreateRoomArg(CreateRoomArg("lobby", "say  hi"))
+	tt.NoError(err)
+	tt.Equal("lobby", name)
+	tt.Equal("say  hi", desc)
+	_, _, err = ParseCreateRoomArg(" ")
+	tt.Error(err)
+
+	page, limit, err := ParseRoomListArg(RoomListArg(2, 10))
+	tt.NoError(err)
+	tt.Equal([]int{2, 10}, []int{page, limit})
+	_, _, err = ParseRoomListArg("1 -1")
+	tt.Error(err)
+
+	room, after, err := ParseWhoArg(WhoArg("", "bob"))
+	tt.NoError(err)
+	tt.Equal([]string{"", "bob"}, []string{room, after})
+	room, after, err = ParseWhoArg(WhoArg("lobby", ""))
+	tt.NoError(err)
+	tt.Equal([]string{"lobby", ""}, []string{room, after})
+	_, _, err = ParseWhoArg("lobby bob carol")
+	tt.Error(err)
+
+	offset, err := ParseInboxArg(InboxArg(3))
+	tt.NoError(err)
+	tt.Equal(3, offset)
+	_, err = ParseInboxArg("-1")
+	tt.Error(err)
+}
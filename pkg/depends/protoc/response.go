@@ -0,0 +1,127 @@
+package protoc
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/saitofun/qlib/encoding/qjson"
+	"github.com/saitofun/qlib/net/qmsg"
+)
+
+// PayloadKind 应答载荷类型
+type PayloadKind uint32
+
+const (
+	PayloadNone         PayloadKind = iota
+	PayloadText                     // 文本, 如错误描述
+	PayloadUser                     // 用户信息
+	PayloadRoom                     // 房间信息
+	PayloadRoomList                 // 房间列表
+	PayloadPopularWords             // 热词列表
+	PayloadHistory                  // 历史消息
+	PayloadInbox                    // 信箱
+	PayloadMembers                  // 房间成员
+)
+
+func (k PayloadKind) String() string {
+	switch k {
+	case PayloadNone:
+		return "NONE"
+	case PayloadText:
+		return "TEXT"
+	case PayloadUser:
+		return "USER"
+	case PayloadRoom:
+		return "ROOM"
+	case PayloadRoomList:
+		return "ROOM_LIST"
+	case PayloadPopularWords:
+		return "POPULAR_WORDS"
+	case PayloadHistory:
+		return "HISTORY"
+	case PayloadInbox:
+		return "INBOX"
+	case PayloadMembers:
+		return "MEMBERS"
+	default:
+		return ""
+	}
+}
+
+// Response srv -> cli 指令应答, Seq与请求一致, Code为0表示成功, Body为JSON编码的载荷
+type Response struct {
+	Header
+	Code uint32
+	Kind PayloadKind
+	Body []byte
+}
+
+var _ qmsg.Message = (*Response)(nil)
+
+func (m *Response) Type() qmsg.Type { return CmdResponse }
+
+func (m *Response) Bytes() []byte {
+	buf := bytes.NewBuffer(nil)
+
+	buf.Write(m.Header.Bytes())
+	buf.Write(BinaryUint32(m.Code))
+	buf.Write(BinaryUint32(uint32(m.Kind)))
+	buf.Write(BinaryText(string(m.Body)))
+
+	return buf.Bytes()
+}
+
+func (m Response) Marshal() ([]byte, error) { return m.Bytes(), nil }
+
+func (m *Response) Unmarshal(dat []byte) error {
+	if err := m.Header.Unmarshal(dat); err != nil {
+		return err
+	}
+	dat = dat[12:]
+	if uint32(len(dat)) != m.Len {
+		return errUnexpectedPayloadLength
+	}
+	if len(dat) < 8 {
+		return errDataLack
+	}
+	m.Code = order.Uint32(dat[0:4])
+	m.Kind = PayloadKind(order.Uint32(dat[4:8]))
+	str, delta, err := ParseString(dat[8:])
+	if err != nil {
+		return err
+	}
+	if 8+delta != m.Len {
+		return errUnexpectedPayloadLength
+	}
+	m.Body = []byte(str)
+	return nil
+}
+
+// Decode 将载荷解码到v
+func (m *Response) Decode(v interface{}) error {
+	if len(m.Body) == 0 {
+		return nil
+	}
+	return qjson.Unmarshal(m.Body, v)
+}
+
+func (m *Response) String() string {
+	return fmt.Sprintf("[%d] %s %s", m.Code, m.Kind, string(m.Body))
+}
+
+func NewResponse(seq Seq, code uint32, kind PayloadKind, v interface{}) *Response {
+	body := []byte(nil)
+	if kind != PayloadNone {
+		body, _ = qjson.Marshal(v)
+	}
+	return &Response{
+		Header: Header{
+			Seq:  seq,
+			Type: CmdResponse,
+			Len:  uint32(12 + len(body)),
+		},
+		Code: code,
+		Kind: kind,
+		Body: body,
+	}
+}
@@ -0,0 +1,45 @@
+package protoc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Resume 断线续传标记, 即客户端最后收到的房间消息的消息ID; 消息ID在房间内唯一且递增
+type Resume struct {
+	MsgID uint64
+}
+
+// NewResume 以收到的房间消息作为续传标记
+func NewResume(msg *Echo) *Resume { return &Resume{MsgID: msg.MsgID} }
+
+// After 消息是否在标记之后
+func (r *Resume) After(msg *Echo) bool { return msg.MsgID > r.MsgID }
+
+var errInvalidRoomArg = errors.New("CHAT:invalid room argument")
+
+// RoomArg 进入房间指令参数: `房间名或房间号[ 消息ID]`, resume不为空时服务端只补发标记之后的历史消息
+func RoomArg(room string, resume *Resume) string {
+	arg := room
+	if resume != nil {
+		arg += " " + strconv.FormatUint(resume.MsgID, 10)
+	}
+	return arg
+}
+
+// ParseRoomArg 解析进入房间指令参数, room为房间名或房间号, 无续传标记时resume为nil
+func ParseRoomArg(arg string) (room string, resume *Resume, err error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", nil, errInvalidRoomArg
+	}
+	if room = fields[0]; len(fields) == 1 {
+		return room, nil, nil
+	}
+	id, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return "", nil, errInvalidRoomArg
+	}
+	return room, &Resume{MsgID: id}, nil
+}
@@ -0,0 +1,84 @@
+package protoc
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidCreateRoomArg = errors.New("CHAT:invalid create room argument")
+	errInvalidRoomListArg   = errors.New("CHAT:invalid room list argument")
+	errInvalidWhoArg        = errors.New("CHAT:invalid who argument")
+)
+
+// RoomNew 进入房间指令参数, 新建无名房间并进入, 房间号由服务端分配
+const RoomNew = "new"
+
+// CreateRoomArg 创建房间指令参数: `房间名[ 简介]`
+func CreateRoomArg(name, description string) string {
+	return strings.TrimSpace(name + " " + description)
+}
+
+// ParseCreateRoomArg 解析创建房间指令参数, 房间名不能为空, 简介可省略
+func ParseCreateRoomArg(arg string) (name, description string, err error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return "", "", errInvalidCreateRoomArg
+	}
+	idx := strings.IndexFunc(arg, func(r rune) bool { return r == ' ' || r == '\t' })
+	if idx < 0 {
+		return arg, "", nil
+	}
+	return arg[:idx], strings.TrimSpace(arg[idx+1:]), nil
+}
+
+// RoomListArg 房间列表指令参数: `[房间号] [条数]`, 从该房间号开始按房间号升序列出, 条数为0使用服务端默认值
+func RoomListArg(from, limit int) string {
+	return strconv.Itoa(from) + " " + strconv.Itoa(limit)
+}
+
+// ParseRoomListArg 解析房间列表指令参数, 省略的参数为0
+func ParseRoomListArg(arg string) (from, limit int, err error) {
+	fields := strings.Fields(arg)
+	if len(fields) > 2 {
+		return 0, 0, errInvalidRoomListArg
+	}
+	if len(fields) > 0 {
+		if from, err = strconv.Atoi(fields[0]); err != nil || from < 0 {
+			return 0, 0, errInvalidRoomListArg
+		}
+	}
+	if len(fields) > 1 {
+		if limit, err = strconv.Atoi(fields[1]); err != nil || limit < 0 {
+			return 0, 0, errInvalidRoomListArg
+		}
+	}
+	return from, limit, nil
+}
+
+// WhoArg 在线用户指令参数: `[房间名或房间号] [用户名]`, 房间为空或0表示当前房间, 只列出用户名在其后的成员
+func WhoArg(room, after string) string {
+	if after == "" {
+		return room
+	}
+	if room == "" {
+		room = "0"
+	}
+	return room + " " + after
+}
+
+// ParseWhoArg 解析在线用户指令参数, 省略的房间及当前房间为空
+func ParseWhoArg(arg string) (room, after string, err error) {
+	fields := strings.Fields(arg)
+	if len(fields) > 2 {
+		return "", "", errInvalidWhoArg
+	}
+	if len(fields) > 0 && fields[0] != "0" {
+		room = fields[0]
+	}
+	if len(fields) > 1 {
+		after = fields[1]
+	}
+	return room, after, nil
+}
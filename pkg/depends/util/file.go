@@ -3,10 +3,8 @@ package util
 import "os"
 
 func IsExist(path string) bool {
-	if _, err := os.Stat(string(path)); err != nil {
-		return os.IsExist(err)
-	}
-	return false
+	_, err := os.Stat(path)
+	return err == nil || os.IsExist(err)
 }
 
 func IsDir(path string) bool {
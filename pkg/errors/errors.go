@@ -2,14 +2,92 @@ package errors
 
 import "errors"
 
+// Code 错误码, 数值一经分配不可修改
+type Code uint32
+
+const (
+	CodeOK              Code = 0
+	CodeUnknown         Code = 1
+	CodeUserExisted     Code = 1001
+	CodeUserNotExisted  Code = 1002
+	CodeUserNotLogin    Code = 1003
+	CodeUserOnline      Code = 1004
+	CodeWrongPassword   Code = 1005
+	CodeUserLocked      Code = 1006
+	CodeInvalidPassword Code = 1007
+	CodeInvalidSession  Code = 1008
+	CodeTooManyDevices  Code = 1009
+	CodePasswordNotSet  Code = 1010
+	CodeNotEnterRoom    Code = 2001
+	CodeInvalidRoomID   Code = 2002
+	CodeRoomIDExists    Code = 2003
+	CodeRoomIDNotExists Code = 2004
+	CodeInvalidRoomName Code = 2005
+	CodeNotRoomCreator  Code = 2006
+	CodeRoomNameExists  Code = 2007
+	CodeUnknownGmCmd    Code = 3001
+	CodeNotNegotiated   Code = 3002
+	CodeInvalidArg      Code = 3003
+)
+
+// Error 携带错误码的业务错误
+type Error struct {
+	Code Code
+	Msg  string
+}
+
+func (e *Error) Error() string { return e.Msg }
+
+func New(code Code, msg string) *Error {
+	ret := &Error{Code: code, Msg: msg}
+	registered[code] = ret
+	return ret
+}
+
+// CodeOf 获取err对应的错误码, nil返回CodeOK, 非业务错误返回CodeUnknown
+func CodeOf(err error) Code {
+	if err == nil {
+		return CodeOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeUnknown
+}
+
+// FromCode 根据错误码还原业务错误, 未知错误码使用msg构造
+func FromCode(code Code, msg string) error {
+	if code == CodeOK {
+		return nil
+	}
+	if e, ok := registered[code]; ok {
+		return e
+	}
+	return &Error{Code: code, Msg: msg}
+}
+
+var registered = make(map[Code]*Error)
+
 var (
-	ErrUserExisted     = errors.New("用户已存在, 请勿重复创建")
-	ErrUserNotExisted  = errors.New("用户不存在, 请先创建用户")
-	ErrUserNotLogin    = errors.New("用户尚未登陆, 请先登录")
-	ErrUserOnline      = errors.New("用户已经登陆, 请勿重复登陆")
-	ErrNotEnterRoom    = errors.New("尚未进入房间, 请选择房间或创建房间")
-	ErrUnknownGmCmd    = errors.New("未知指令")
-	ErrInvalidRoomID   = errors.New("非法的房间号")
-	ErrRoomIDExists    = errors.New("房间已存在")
-	ErrRoomIDNotExists = errors.New("房间号不存在")
+	ErrUserExisted     = New(CodeUserExisted, "用户已存在, 请勿重复创建")
+	ErrUserNotExisted  = New(CodeUserNotExisted, "用户不存在, 请先创建用户")
+	ErrUserNotLogin    = New(CodeUserNotLogin, "用户尚未登陆, 请先登录")
+	ErrUserOnline      = New(CodeUserOnline, "用户已经登陆, 请勿重复登陆")
+	ErrWrongPassword   = New(CodeWrongPassword, "密码错误")
+	ErrUserLocked      = New(CodeUserLocked, "密码错误次数过多, 请稍后再试")
+	ErrInvalidPassword = New(CodeInvalidPassword, "密码须为6-72个字符且不能包含空白")
+	ErrInvalidSession  = New(CodeInvalidSession, "会话无效或已过期, 请重新登录")
+	ErrTooManyDevices  = New(CodeTooManyDevices, "同时登录的设备数已达上限")
+	ErrPasswordNotSet  = New(CodePasswordNotSet, "账号尚未设置密码, 请联系管理员重置密码")
+	ErrNotEnterRoom    = New(CodeNotEnterRoom, "尚未进入房间, 请选择房间或创建房间")
+	ErrUnknownGmCmd    = New(CodeUnknownGmCmd, "未知指令")
+	ErrInvalidRoomID   = New(CodeInvalidRoomID, "非法的房间号")
+	ErrRoomIDExists    = New(CodeRoomIDExists, "房间已存在")
+	ErrRoomIDNotExists = New(CodeRoomIDNotExists, "房间号不存在")
+	ErrInvalidRoomName = New(CodeInvalidRoomName, "房间名须为1-32个小写字母、数字、-或_, 不能全为数字且不能为new")
+	ErrNotRoomCreator  = New(CodeNotRoomCreator, "只有房间创建者可以修改话题")
+	ErrRoomNameExists  = New(CodeRoomNameExists, "房间名已存在")
+	ErrNotNegotiated   = New(CodeNotNegotiated, "尚未完成协议握手")
+	ErrInvalidArg      = New(CodeInvalidArg, "非法的指令参数")
 )
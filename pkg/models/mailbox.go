@@ -0,0 +1,140 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/saitofun/chat/pkg/depends/protoc"
+)
+
+// MailKind 信箱消息类型
+type MailKind string
+
+const (
+	MailDirect  MailKind = "direct"  // MailDirect 私信
+	MailMention MailKind = "mention" // MailMention 房间消息中被@提及
+)
+
+// Mail 用户离线期间收到的消息
+type Mail struct {
+	Kind      MailKind  `json:"kind"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Room      int       `json:"room,omitempty"` // Room 提及所在的房间
+	Body      string    `json:"body"`
+	Time      time.Time `json:"time"`
+	Delivered bool      `json:"delivered"`           // Delivered 是否已在登录后投递
+	Truncated bool      `json:"truncated,omitempty"` // Truncated 内容过长, 在信箱应答中已截断
+}
+
+// NewDirectMail 由私信创建信箱消息
+func NewDirectMail(msg *protoc.Direct) *Mail {
+	return &Mail{Kind: MailDirect, From: msg.From, To: msg.To, Body: msg.Body, Time: msg.SentAt()}
+}
+
+// NewMentionMail 由房间room中提及用户to的消息创建信箱消息
+func NewMentionMail(msg *protoc.Echo, to string, room int) *Mail {
+	return &Mail{Kind: MailMention, From: msg.From, To: to, Room: room, Body: msg.Body, Time: msg.PubAt()}
+}
+
+// Direct 以私信投递的信箱消息
+func (m *Mail) Direct(seq protoc.Seq) *protoc.Direct {
+	return protoc.NewDirect(seq, m.From, m.To, m.Body, m.Time)
+}
+
+// Notice 以通知投递的提及内容
+func (m *Mail) Notice() string { return MentionNotice(m.From, m.Room, m.Body) }
+
+func (m *Mail) String() string {
+	ret := fmt.Sprintf("%s [私信] %s -> %s: %s", m.Time.Format("2006-01-02 15:04:05"), m.From, m.To, m.Body)
+	if m.Kind == MailMention {
+		ret = fmt.Sprintf("%s [提及] %s", m.Time.Format("2006-01-02 15:04:05"), m.Notice())
+	}
+	if m.Truncated {
+		ret += "...(已截断)"
+	}
+	return ret
+}
+
+func (m *Mail) size() int { return encodedSize(m) }
+
+// truncate 截断消息内容使编码长度不超过max
+func (m *Mail) truncate(max int) {
+	m.Truncated = true
+	truncate(&m.Body, max, m.size)
+}
+
+// Deposit 存入信箱, 超出max条时丢弃最早的消息
+func (u *User) Deposit(m *Mail, max int) {
+	u.Mailbox = append(u.Mailbox, m)
+	if drop := len(u.Mailbox) - max; drop > 0 {
+		u.Mailbox = append([]*Mail(nil), u.Mailbox[drop:]...)
+	}
+}
+
+// Undelivered 按存入顺序返回尚未投递的消息并标记为已投递
+func (u *User) Undelivered() []*Mail {
+	var ret []*Mail
+	for _, m := range u.Mailbox {
+		if !m.Delivered {
+			m.Delivered = true
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// Inbox 信箱应答载荷, Mails按存入顺序
+type Inbox struct {
+	Mails  []Mail `json:"mails"`
+	Offset int    `json:"offset"` // Offset 本页第一条消息在信箱中的序号, 从0开始
+	Total  int    `json:"total"`  // Total 信箱中的消息数
+	More   bool   `json:"more"`   // More 是否还有更晚存入的消息
+}
+
+// NewInbox 从序号offset开始的一页信箱, 应答不超过单帧最大长度maxFrameSize, 超出时返回较少的消息,
+// 其余经游标继续查询; 单条消息即超出时截断其内容
+func NewInbox(mailbox []*Mail, offset int, maxFrameSize uint32) *Inbox {
+	if offset > len(mailbox) {
+		offset = len(mailbox)
+	}
+	ret := &Inbox{Mails: make([]Mail, 0), Offset: offset, Total: len(mailbox)}
+	budget := pageBudget(maxFrameSize)
+	for i := offset; i < len(mailbox); i++ {
+		m := *mailbox[i]
+		size := m.size()
+		if size > budget {
+			if len(ret.Mails) == 0 {
+				m.truncate(budget)
+				ret.Mails = append(ret.Mails, m)
+			}
+			break
+		}
+		budget -= size
+		ret.Mails = append(ret.Mails, m)
+	}
+	ret.More = offset+len(ret.Mails) < len(mailbox)
+	return ret
+}
+
+// Next 下一页的游标, 即本页之后第一条消息的序号; 没有更多消息时为0
+func (in *Inbox) Next() int {
+	if !in.More {
+		return 0
+	}
+	return in.Offset + len(in.Mails)
+}
+
+func (in *Inbox) String() string {
+	if in.Total == 0 {
+		return "\n信箱为空"
+	}
+	ret := fmt.Sprintf("\n信箱(共%d条):", in.Total)
+	for i := range in.Mails {
+		ret += "\n" + in.Mails[i].String()
+	}
+	if next := in.Next(); next != 0 {
+		ret += fmt.Sprintf("\n下一页: /inbox %d", next)
+	}
+	return ret
+}
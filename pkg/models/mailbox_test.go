@@ -0,0 +1,52 @@
+package models_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInboxSize(t *testing.T) {
+	tt := require.New(t)
+
+	u := &models.User{Name: "bob"}
+	for i := 0; i < config.MaxMailboxSize; i++ {
+		u.Deposit(&models.Mail{Kind: models.MailDirect, From: "alice", To: "bob", Body: strings.Repeat("x", 4096), Time: time.Now()}, config.MaxMailboxSize)
+	}
+
+	// 每页应答不超过单帧最大长度, 经游标按存入顺序取回全部消息
+	var (
+		offset int
+		total  int
+		pages  int
+	)
+	for {
+		in := models.NewInbox(u.Mailbox, offset, config.MaxFrameSize)
+		tt.True(models.NewResponse(1, in).Len <= config.MaxFrameSize)
+		tt.Equal(offset, in.Offset)
+		total += len(in.Mails)
+		pages++
+		if offset = in.Next(); offset == 0 {
+			break
+		}
+	}
+	tt.Equal(config.MaxMailboxSize, total)
+	tt.True(pages > 1)
+
+	// 单条消息即超出时截断内容
+	u.Deposit(&models.Mail{Kind: models.MailDirect, From: "alice", To: "bob", Body: strings.Repeat("<", int(config.MaxFrameSize))}, config.MaxMailboxSize)
+	in := models.NewInbox(u.Mailbox, len(u.Mailbox)-1, config.MaxFrameSize)
+	tt.True(models.NewResponse(1, in).Len <= config.MaxFrameSize)
+	tt.Len(in.Mails, 1)
+	tt.True(in.Mails[0].Truncated)
+	tt.False(in.More)
+
+	// 序号越界时返回空页
+	in = models.NewInbox(u.Mailbox, len(u.Mailbox)+1, config.MaxFrameSize)
+	tt.Empty(in.Mails)
+	tt.Equal(len(u.Mailbox), in.Offset)
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ParseMentions 解析消息中`@用户名`形式的提及, 按出现顺序去重; 用户名以空白或`@`结束, 并去掉末尾的标点
+func ParseMentions(body string) []string {
+	var (
+		ret  []string
+		seen = make(map[string]bool)
+	)
+	for _, field := range strings.FieldsFunc(body, unicode.IsSpace) {
+		for _, part := range strings.Split(field, "@")[1:] {
+			name := strings.TrimRightFunc(part, unicode.IsPunct)
+			if name != "" && !seen[name] {
+				seen[name] = true
+				ret = append(ret, name)
+			}
+		}
+	}
+	return ret
+}
+
+// MentionNotice 提及通知内容
+func MentionNotice(from string, room int, body string) string {
+	return fmt.Sprintf("%s 在房间%d提到了你: %s", from, room, body)
+}
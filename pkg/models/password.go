@@ -0,0 +1,39 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/saitofun/chat/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	MinPasswordLen = 6
+	MaxPasswordLen = 72 // MaxPasswordLen bcrypt只使用前72字节
+)
+
+// HashPassword 校验密码格式并以强度为cost的bcrypt哈希
+func HashPassword(password string, cost int) (string, error) {
+	if len(password) < MinPasswordLen || len(password) > MaxPasswordLen ||
+		strings.IndexFunc(password, unicode.IsSpace) >= 0 {
+		return "", errors.ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword 校验密码与哈希是否匹配; 未设置密码的用户(hash为空)不能通过校验,
+// 须由管理员重置密码
+func CheckPassword(hash, password string) error {
+	if hash == "" {
+		return errors.ErrPasswordNotSet
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return errors.ErrWrongPassword
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/errors"
+)
+
+// NewResponse 将指令处理结果封装为结构化应答
+func NewResponse(seq protoc.Seq, v interface{}) *protoc.Response {
+	code, kind, payload := errors.CodeOK, protoc.PayloadNone, interface{}(nil)
+
+	switch pl := v.(type) {
+	case error:
+		code, kind, payload = errors.CodeOf(pl), protoc.PayloadText, pl.Error()
+	case string:
+		kind, payload = protoc.PayloadText, pl
+	case *UserProfile:
+		kind, payload = protoc.PayloadUser, pl
+	case *Room:
+		kind, payload = protoc.PayloadRoom, pl.Summary()
+	case *RoomPage:
+		kind, payload = protoc.PayloadRoomList, pl
+	case PopularWords:
+		kind, payload = protoc.PayloadPopularWords, pl.Counts()
+	case *History:
+		kind, payload = protoc.PayloadHistory, pl
+	case *Inbox:
+		kind, payload = protoc.PayloadInbox, pl
+	case *RoomMembers:
+		kind, payload = protoc.PayloadMembers, pl
+	}
+	return protoc.NewResponse(seq, uint32(code), kind, payload)
+}
+
+// DecodeResponse 解析结构化应答, 失败的应答还原为对应错误码的业务错误
+func DecodeResponse(rsp *protoc.Response) (interface{}, error) {
+	var v interface{}
+
+	switch rsp.Kind {
+	case protoc.PayloadNone:
+		return nil, errors.FromCode(errors.Code(rsp.Code), "")
+	case protoc.PayloadText:
+		text := ""
+		if err := rsp.Decode(&text); err != nil {
+			return nil, err
+		}
+		if rsp.Code != uint32(errors.CodeOK) {
+			return nil, errors.FromCode(errors.Code(rsp.Code), text)
+		}
+		return text, nil
+	case protoc.PayloadUser:
+		v = &UserProfile{}
+	case protoc.PayloadRoom:
+		v = &RoomSummary{}
+	case protoc.PayloadRoomList:
+		v = &RoomPage{}
+	case protoc.PayloadPopularWords:
+		v = &WordCounts{}
+	case protoc.PayloadHistory:
+		v = &History{}
+	case protoc.PayloadInbox:
+		v = &Inbox{}
+	case protoc.PayloadMembers:
+		v = &RoomMembers{}
+	default:
+		return nil, errors.FromCode(errors.Code(rsp.Code), rsp.Kind.String())
+	}
+	if err := rsp.Decode(v); err != nil {
+		return nil, err
+	}
+	return v, errors.FromCode(errors.Code(rsp.Code), "")
+}
@@ -0,0 +1,51 @@
+package models_test
+
+import (
+	stderrors "errors"
+	"fmt"
+	"testing"
+
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseCode(t *testing.T) {
+	tt := require.New(t)
+
+	unknown := stderrors.New("boom")
+
+	cases := []struct {
+		name string
+		v    interface{}
+		code errors.Code
+		err  error // err 客户端解码后还原的错误
+	}{
+		{"OK", "done", errors.CodeOK, nil},
+		{"Business", errors.ErrUserNotLogin, errors.CodeUserNotLogin, errors.ErrUserNotLogin},
+		{"Wrapped", fmt.Errorf("enter room: %w", errors.ErrRoomIDNotExists), errors.CodeRoomIDNotExists,
+			errors.ErrRoomIDNotExists},
+		{"Unknown", unknown, errors.CodeUnknown, &errors.Error{Code: errors.CodeUnknown, Msg: "boom"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rsp := models.NewResponse(1, c.v)
+			tt.Equal(uint32(c.code), rsp.Code)
+			tt.Equal(protoc.PayloadText, rsp.Kind)
+			_, err := models.DecodeResponse(rsp)
+			tt.Equal(c.err, err)
+			if err != nil {
+				tt.Equal(c.code, errors.CodeOf(err))
+			}
+		})
+	}
+
+	// 未注册的错误码按原样还原
+	err := errors.FromCode(9999, "future error")
+	tt.Equal(errors.Code(9999), errors.CodeOf(err))
+	tt.Equal("future error", err.Error())
+	tt.Equal(errors.CodeOK, errors.CodeOf(nil))
+	tt.Nil(errors.FromCode(errors.CodeOK, ""))
+}
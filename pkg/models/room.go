@@ -1,113 +1,819 @@
 package models
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/saitofun/chat/cmd/config"
 	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/errors"
 	"github.com/saitofun/chat/pkg/modules/frequency_stat"
 	"github.com/saitofun/chat/pkg/modules/profanity_words"
-	"github.com/saitofun/qlib/container/qlist"
+	"github.com/saitofun/qlib/encoding/qjson"
+	"github.com/saitofun/qlib/net/qmsg"
 	"github.com/saitofun/qlib/util/qstrings"
 )
 
-type Rooms []Room
+// RoomMeta 房间元数据
+type RoomMeta struct {
+	Name        string    `json:"name,omitempty"` // Name 房间名, 全局唯一; 按房间号创建的早期房间为空
+	Topic       string    `json:"topic,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Creator     string    `json:"creator,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Temporary 是否为临时房间, 即由`/room new`创建的无名房间, 最后一个连接离开后释放
+func (m RoomMeta) Temporary() bool { return m.Name == "" && m.Creator != "" }
+
+// MaxRoomNameLen 房间名最大长度
+const MaxRoomNameLen = 32
+
+// ParseRoomName 校验房间名并转为小写: 1-32个字母、数字、-或_, 不能全为数字以便与房间号区分,
+// 不能为保留的protoc.RoomNew
+func ParseRoomName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || len(name) > MaxRoomNameLen || name == protoc.RoomNew {
+		return "", errors.ErrInvalidRoomName
+	}
+	digits := true
+	for _, c := range name {
+		switch {
+		case c >= '0' && c <= '9':
+		case c >= 'a' && c <= 'z', c == '-', c == '_':
+			digits = false
+		default:
+			return "", errors.ErrInvalidRoomName
+		}
+	}
+	if digits {
+		return "", errors.ErrInvalidRoomName
+	}
+	return name, nil
+}
+
+// RoomSummary 房间信息应答载荷
+type RoomSummary struct {
+	ID int `json:"id"`
+	RoomMeta
+	UserCount int    `json:"userCount"`
+	Dropped   uint64 `json:"dropped,omitempty"`   // Dropped 因连接消费过慢丢弃的消息数
+	Evicted   int    `json:"evicted,omitempty"`   // Evicted 因消费过慢被断开的连接数
+	Truncated bool   `json:"truncated,omitempty"` // Truncated 简介或话题过长, 已截断
+}
 
-func (rs Rooms) String() string {
+func (s *RoomSummary) String() string {
+	ret := "\n" + s.line()
+	if s.Creator != "" {
+		ret += fmt.Sprintf("创建者: %s 创建时间: %s\n", s.Creator, s.CreatedAt.Format("2006-01-02 15:04:05"))
+	}
+	if s.Description != "" {
+		ret += fmt.Sprintf("简介: %s\n", s.Description)
+	}
+	return ret
+}
+
+func (s *RoomSummary) line() string {
+	ret := fmt.Sprintf("房间号: %-3d", s.ID)
+	if s.Name != "" {
+		ret += fmt.Sprintf(" 房间名: %s", s.Name)
+	}
+	ret += fmt.Sprintf(" 当前在线用户: %d", s.UserCount)
+	if s.Topic != "" {
+		ret += fmt.Sprintf(" 话题: %s", s.Topic)
+	}
+	if s.Dropped > 0 || s.Evicted > 0 {
+		ret += fmt.Sprintf(" 丢弃消息: %d 断开连接: %d", s.Dropped, s.Evicted)
+	}
+	return ret + "\n"
+}
+
+func (s *RoomSummary) size() int { return encodedSize(s) }
+
+// truncate 依次截断简介和话题使编码长度不超过max
+func (s *RoomSummary) truncate(max int) {
+	s.Truncated = true
+	if !truncate(&s.Description, max, s.size) {
+		truncate(&s.Topic, max, s.size)
+	}
+}
+
+// RoomSummaries 房间列表应答载荷
+type RoomSummaries []RoomSummary
+
+func (ss RoomSummaries) String() string {
 	ret := "\n"
-	for i := range rs {
-		ret += fmt.Sprintf("房间号: %-3d 当前在线用户: %d\n", rs[i].Id, rs[i].UserCount())
+	for i := range ss {
+		ret += ss[i].line()
+	}
+	return ret
+}
+
+const (
+	DefaultRoomListLimit = 20  // DefaultRoomListLimit 房间列表默认每页条数
+	MaxRoomListLimit     = 100 // MaxRoomListLimit 房间列表每页最大条数
+)
+
+// RoomPage 房间列表应答载荷, Rooms按房间号升序
+type RoomPage struct {
+	Rooms RoomSummaries `json:"rooms"`
+	Total int           `json:"total"` // Total 房间总数
+	More  bool          `json:"more"`  // More 是否还有房间号更大的房间
+}
+
+// NewRoomPage 由按房间号升序的房间信息创建一页房间列表, more为rooms之后是否还有房间.
+// 应答不超过单帧最大长度maxFrameSize, 超出时只保留靠前的房间, 其余经游标继续查询;
+// 单个房间即超出时截断其简介及话题
+func NewRoomPage(rooms []RoomSummary, total int, more bool, maxFrameSize uint32) *RoomPage {
+	ret := &RoomPage{Rooms: make(RoomSummaries, 0, len(rooms)), Total: total, More: more}
+	budget := pageBudget(maxFrameSize)
+	for i := range rooms {
+		s := rooms[i]
+		size := s.size()
+		if size > budget {
+			if len(ret.Rooms) == 0 {
+				s.truncate(budget)
+				ret.Rooms = append(ret.Rooms, s)
+			}
+			ret.More = ret.More || len(ret.Rooms) < len(rooms)
+			break
+		}
+		budget -= size
+		ret.Rooms = append(ret.Rooms, s)
+	}
+	return ret
+}
+
+// Next 下一页的游标, 即本页最后一个房间号加1; 没有更多房间时为0
+func (p *RoomPage) Next() int {
+	if !p.More || len(p.Rooms) == 0 {
+		return 0
+	}
+	return p.Rooms[len(p.Rooms)-1].ID + 1
+}
+
+func (p *RoomPage) String() string {
+	ret := fmt.Sprintf("\n房间列表(共%d个房间):", p.Total) + p.Rooms.String()
+	if next := p.Next(); next != 0 {
+		ret += fmt.Sprintf("下一页: /rooms %d", next)
 	}
 	return ret
 }
 
 type Room struct {
-	Id    int
-	mq    chan *protoc.Echo
-	pop   *frequency_stat.OrderedSet
-	mtx   *sync.Mutex
-	users map[string]chan *protoc.Echo
-	cache *qlist.List
+	Id     int
+	mq     chan *protoc.Echo
+	pop    *frequency_stat.OrderedSet
+	filter *profanity_words.Filter
+	mtx    *sync.Mutex
+	users  map[string]*member // users 按连接订阅房间消息, 同一用户的多个连接分别订阅
+	hist   []*protoc.Echo     // hist 按ID升序的历史消息, 按保留策略清理
+	origin map[uint64]string  // origin 运行中发布的历史消息的来源标识, 按消息ID, 随hist清理
+	lastID uint64             // lastID 最后分配的消息ID
+	store  MessageStore       // store 消息持久化, 为nil不持久化
+	quiet  bool               // quiet 不广播用户进出通知, 按房间号及房间名匹配config.Settings.QuietRooms
+	muted  bool               // muted 暂停广播用户进出通知, 见SetMuted
+	meta   RoomMeta
+	conf   *config.Settings
+	closed bool          // closed 房间已释放, 不能再进入
+	empty  func(r *Room) // empty 最后一个连接离开后在新协程中调用, 见SetOnEmpty
+
+	unsaved []*protoc.Echo // unsaved 待持久化的消息, 按ID升序
+	saving  bool           // saving 是否有协程正在写入unsaved, 见save
+
+	dropped uint64 // dropped 因队列已满丢弃的消息数
+	evicted int    // evicted 因队列已满断开的连接数
+}
+
+// member 房间内的一个连接, ch为待投递的消息及通知队列
+type member struct {
+	name     string
+	origin   string // origin 连接的来源标识, 见Entry
+	ch       chan qmsg.Message
+	dropped  uint64
+	joinedAt time.Time
+	activeAt time.Time // activeAt 最后一次在房间内发言的时间
 }
 
-func NewRoom(id int) *Room {
+// 连接的消息队列已满时的处理策略, 由config.Settings.RoomQueuePolicy指定
+const (
+	QueueDropOldest = "drop-oldest" // QueueDropOldest 丢弃队列中最早的消息
+	QueueDropNewest = "drop-newest" // QueueDropNewest 丢弃新发布的消息
+	QueueDisconnect = "disconnect"  // QueueDisconnect 关闭队列, 断开消费过慢的连接
+)
+
+// MessageStore 房间消息持久化
+type MessageStore interface {
+	AppendMessage(room int, msg *protoc.Echo) error
+}
+
+// NewRoom 创建房间, filter为nil时不过滤敏感词, conf为nil时使用当前全局配置
+func NewRoom(id int, filter *profanity_words.Filter, conf *config.Settings) *Room {
+	if conf == nil {
+		conf = config.Current()
+	}
 	return &Room{
-		Id:    id,
-		mq:    make(chan *protoc.Echo, config.MaxRoomCache),
-		pop:   frequency_stat.NewSet(config.PopularWordsKeepDuration),
-		mtx:   &sync.Mutex{},
-		users: make(map[string]chan *protoc.Echo, config.MaxRoomCache),
-		cache: qlist.New(),
+		Id:     id,
+		mq:     make(chan *protoc.Echo, conf.MaxRoomCache),
+		pop:    frequency_stat.NewSet(conf.PopularWordsKeepDuration),
+		filter: filter,
+		mtx:    &sync.Mutex{},
+		users:  make(map[string]*member, conf.MaxRoomCache),
+		origin: make(map[uint64]string),
+		quiet:  conf.QuietRoom(id, ""),
+		meta:   RoomMeta{CreatedAt: time.Now()},
+		conf:   conf,
 	}
 }
 
-// Pub 用户发布消息
-func (r *Room) Pub(msg *protoc.Echo) {
+// Pub 用户在连接origin上发布消息, 按发布顺序分配递增的消息ID和发布时间;
+// 消息投递给房间内除origin外的全部连接, 包括该用户的其他设备; 投递及持久化均不阻塞, 见deliver和save
+func (r *Room) Pub(msg *protoc.Echo, origin string) {
 	original := msg.Body
-	msg.SetBody(profanity_words.MaskWordsBy(msg.Body, config.ProfanityWordsMask))
+	if r.filter != nil {
+		msg.SetBody(r.filter.MaskWordsBy(msg.Body, r.conf.ProfanityWordsMask))
+	}
 	r.pop.AddWords(qstrings.SplitToWords(original)...)
 
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
-	for _, ch := range r.users {
-		ch <- msg
+	now := time.Now()
+	r.lastID++
+	msg.SetMeta(r.lastID, now)
+	if m, ok := r.users[origin]; ok {
+		m.activeAt = now
+		r.origin[msg.MsgID] = m.origin
+	}
+	if r.store != nil {
+		r.unsaved = append(r.unsaved, msg)
+		if !r.saving {
+			r.saving = true
+			go r.save()
+		}
+	}
+	r.broadcast(msg, origin)
+	r.hist = append(r.hist, msg)
+	r.prune(now)
+}
+
+// save 在锁外按ID顺序写入待持久化的消息, 直到没有新消息; 存储较慢时不阻塞发布及投递
+func (r *Room) save() {
+	for {
+		r.mtx.Lock()
+		msgs, s := r.unsaved, r.store
+		r.unsaved = nil
+		if len(msgs) == 0 {
+			r.saving = false
+			r.mtx.Unlock()
+			return
+		}
+		r.mtx.Unlock()
+
+		for _, msg := range msgs {
+			if err := s.AppendMessage(r.Id, msg); err != nil {
+				log.Printf("room %d: save message %d: %v", r.Id, msg.MsgID, err)
+			}
+		}
+	}
+}
+
+// broadcast 向房间内除except外的全部连接投递消息, 因消费过慢断开的连接随即离开房间; 调用方持有r.mtx
+func (r *Room) broadcast(msg qmsg.Message, except string) {
+	var evicted []string
+	for cid, m := range r.users {
+		if cid != except && !r.deliver(cid, m, msg) {
+			evicted = append(evicted, m.name)
+		}
+	}
+	for _, name := range evicted {
+		r.left(name)
+	}
+}
+
+// deliver 向连接cid的队列投递消息, 队列已满时按RoomQueuePolicy配置处理并计数;
+// 连接因此断开时返回false; 调用方持有r.mtx
+func (r *Room) deliver(cid string, m *member, msg qmsg.Message) bool {
+	select {
+	case m.ch <- msg:
+		return true
+	default:
+	}
+
+	r.dropped++
+	if m.dropped++; m.dropped == 1 {
+		log.Printf("room %d: %s is consuming too slowly, policy %s", r.Id, m.name, r.conf.RoomQueuePolicy)
+	}
+	switch r.conf.RoomQueuePolicy {
+	case QueueDropNewest:
+	case QueueDisconnect:
+		delete(r.users, cid)
+		close(m.ch)
+		r.evicted++
+		return false
+	default:
+		select {
+		case <-m.ch:
+		default:
+		}
+		select {
+		case m.ch <- msg:
+		default:
+		}
+	}
+	return true
+}
+
+// online 用户name是否有连接在房间内; 调用方持有r.mtx
+func (r *Room) online(name string) bool {
+	for _, m := range r.users {
+		if m.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// announce 向除except外的连接广播用户进出通知; 调用方持有r.mtx
+func (r *Room) announce(kind protoc.NoticeKind, name, except string) {
+	if r.quiet || r.muted {
+		return
+	}
+	body := fmt.Sprintf("%s 进入了房间%s", name, r.label())
+	if kind == protoc.NoticeLeave {
+		body = fmt.Sprintf("%s 离开了房间%s", name, r.label())
+	}
+	r.broadcast(protoc.NewNotice(0, kind, body), except)
+}
+
+// label 通知中的房间称呼, 有房间名时使用房间名, 否则使用房间号; 调用方持有r.mtx
+func (r *Room) label() string {
+	if r.meta.Name != "" {
+		return r.meta.Name
+	}
+	return strconv.Itoa(r.Id)
+}
+
+// left 用户name的一个连接已离开房间, 该用户的最后一个连接离开时广播离开通知; 调用方持有r.mtx
+func (r *Room) left(name string) {
+	if !r.online(name) {
+		log.Printf("%s leaved room %d", name, r.Id)
+		r.announce(protoc.NoticeLeave, name, "")
+	}
+}
+
+// Meta 房间元数据
+func (r *Room) Meta() RoomMeta {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.meta
+}
+
+// SetMeta 设置房间元数据, 用于创建及恢复房间; 按房间名重新匹配QuietRooms
+func (r *Room) SetMeta(meta RoomMeta) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.meta = meta
+	r.quiet = r.conf.QuietRoom(r.Id, meta.Name)
+}
+
+// SetTopic 用户name修改房间话题, 向房间内的连接广播话题通知; 有创建者的房间只允许创建者修改,
+// 升级前按房间号创建的房间没有创建者, 任何成员均可修改
+func (r *Room) SetTopic(topic, name string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.meta.Creator != "" && r.meta.Creator != name {
+		return errors.ErrNotRoomCreator
+	}
+	r.meta.Topic = topic
+	r.broadcast(protoc.NewNotice(0, protoc.NoticeTopic, fmt.Sprintf("%s 将房间%s的话题修改为: %s", name, r.label(), topic)), "")
+	return nil
+}
+
+// SetQuiet 设置是否广播用户进出通知
+func (r *Room) SetQuiet(quiet bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.quiet = quiet
+}
+
+// SetMuted 暂停或恢复广播用户进出通知, 不改变房间本身的quiet设置, 用于服务关闭时用户集中下线
+func (r *Room) SetMuted(muted bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.muted = muted
+}
+
+// SetStore 设置消息持久化, 此后发布的消息写入s
+func (r *Room) SetStore(s MessageStore) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.store = s
+}
+
+// Restore 恢复已保存的消息, lastID为最后分配的消息ID
+func (r *Room) Restore(lastID uint64, msgs []*protoc.Echo) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.hist = append(r.hist[:0], msgs...)
+	r.origin = make(map[uint64]string)
+	if lastID > r.lastID {
+		r.lastID = lastID
+	}
+	r.prune(time.Now())
+}
+
+// prune 按保留策略清理历史消息: 最多保留MaxRoomHistory条, 且不早于RoomHistoryKeepDuration
+func (r *Room) prune(now time.Time) {
+	drop := len(r.hist) - r.conf.MaxRoomHistory
+	if drop < 0 {
+		drop = 0
+	}
+	if keep := r.conf.RoomHistoryKeepDuration; keep > 0 {
+		for drop < len(r.hist) && now.Sub(r.hist[drop].PubAt()) > keep {
+			drop++
+		}
 	}
-	r.cache.PushBack(msg)
-	for r.cache.Len() > 50 {
-		r.cache.PopFront()
+	for _, msg := range r.hist[:drop] {
+		delete(r.origin, msg.MsgID)
 	}
+	r.hist = r.hist[drop:]
 }
 
-// Entry 用户进入房间
-func (r *Room) Entry(username string) ([]*protoc.Echo, <-chan *protoc.Echo) {
-	ch := make(chan *protoc.Echo, config.MaxRoomCache)
+// Entry 用户username以连接cid进入房间, 返回最近MaxRoomCache条历史消息; resume不为空时只返回标记之后的消息.
+// origin为连接的来源标识(登录会话或连接), 同一来源发布的消息已在发送端显示, 不再返回; 同一用户其他设备发布的消息照常返回.
+// 用户的第一个连接进入时向房间内其他连接广播进入通知. 返回的队列投递房间消息及通知,
+// 在连接消费过慢且策略为QueueDisconnect时被关闭. 房间已释放时返回ErrRoomIDNotExists
+func (r *Room) Entry(cid, origin, username string, resume *protoc.Resume) ([]*protoc.Echo, <-chan qmsg.Message, error) {
+	now := time.Now()
+	ch := make(chan qmsg.Message, r.conf.RoomQueueSize)
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
-	r.users[username] = ch
-	cache := r.cache.Elements()
-	histories := make([]*protoc.Echo, 0)
-	for _, msg := range cache {
-		histories = append(histories, msg.(*protoc.Echo))
+	if r.closed {
+		return nil, nil, errors.ErrRoomIDNotExists
+	}
+	joined := !r.online(username)
+	r.users[cid] = &member{name: username, origin: origin, ch: ch, joinedAt: now, activeAt: now}
+	if joined {
+		r.announce(protoc.NoticeJoin, username, cid)
+	}
+	r.prune(time.Now())
+	histories := r.hist
+	if len(histories) > r.conf.MaxRoomCache {
+		histories = histories[len(histories)-r.conf.MaxRoomCache:]
+	}
+	// 标记大于最后分配的消息ID时(如未持久化的房间重启后消息ID重新分配)视为无效, 返回全部缓存
+	if resume != nil && resume.MsgID <= r.lastID {
+		i := sort.Search(len(histories), func(i int) bool { return resume.After(histories[i]) })
+		histories = histories[i:]
+	}
+	cache := make([]*protoc.Echo, 0, len(histories))
+	for _, msg := range histories {
+		if o, ok := r.origin[msg.MsgID]; !ok || o != origin {
+			cache = append(cache, msg)
+		}
 	}
 	log.Printf("%s entered room %d", username, r.Id)
-	return histories, ch
+	return cache, ch, nil
 }
 
-// Leave 用户离开
-func (r *Room) Leave(username string) {
+const (
+	DefaultHistoryLimit = 20  // DefaultHistoryLimit 历史消息默认每页条数
+	MaxHistoryLimit     = 100 // MaxHistoryLimit 历史消息每页最大条数
+
+	pageReserve = 512 // pageReserve 分页应答帧中列表以外的预留长度, 小于config.MinFrameSize
+)
+
+// pageBudget 分页应答中列表的可用长度, 使应答不超过单帧最大长度maxFrameSize
+func pageBudget(maxFrameSize uint32) int {
+	if budget := int(maxFrameSize) - pageReserve; budget > 0 {
+		return budget
+	}
+	return 0
+}
+
+// encodedSize 列表元素在应答载荷中的编码长度, 含列表分隔符
+func encodedSize(v interface{}) int {
+	dat, _ := qjson.Marshal(v)
+	return len(dat) + 1
+}
+
+// truncate 截断*s使size()不超过max, 转义字符编码后变长, 按比例逐步截断; 返回截断后是否满足
+func truncate(s *string, max int, size func() int) bool {
+	n := size()
+	for ; n > max && *s != ""; n = size() {
+		cut := len(*s) * max / n
+		for cut > 0 && !utf8.RuneStart((*s)[cut]) {
+			cut--
+		}
+		*s = (*s)[:cut]
+	}
+	return n <= max
+}
+
+// History 分页查询历史消息, 返回ID小于before的最后limit条, before为0时从最新消息开始.
+// 一页的应答不超过MaxFrameSize, 超出时返回较少的消息, 其余经游标继续查询;
+// 单条消息即超出时截断其内容
+func (r *Room) History(before uint64, limit int) *History {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
+	}
+
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
-	log.Printf("%s leaved room %d", username, r.Id)
-	delete(r.users, username)
+	r.prune(time.Now())
+	end := len(r.hist)
+	if before != 0 {
+		end = sort.Search(len(r.hist), func(i int) bool { return r.hist[i].MsgID >= before })
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	budget := pageBudget(r.conf.MaxFrameSize)
+	msgs := make([]HistoryMessage, 0, end-start)
+	first := end
+	for i := end - 1; i >= start; i-- {
+		m := newHistoryMessage(r.hist[i])
+		size := m.size()
+		if size > budget {
+			if len(msgs) == 0 {
+				m.truncate(budget)
+				msgs, first = append(msgs, m), i
+			}
+			break
+		}
+		budget -= size
+		msgs, first = append(msgs, m), i
+	}
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return &History{Room: r.Id, More: first > 0, Messages: msgs}
+}
+
+// HistoryMessage 历史消息
+type HistoryMessage struct {
+	ID        uint64    `json:"id"`
+	From      string    `json:"from"`
+	Body      string    `json:"body"`
+	Time      time.Time `json:"time"`
+	Mentions  []string  `json:"mentions,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"` // Truncated 内容过长, 已截断
+}
+
+func newHistoryMessage(msg *protoc.Echo) HistoryMessage {
+	return HistoryMessage{
+		ID:       msg.MsgID,
+		From:     msg.From,
+		Body:     msg.Body,
+		Time:     msg.PubAt(),
+		Mentions: msg.Mentions,
+	}
+}
+
+// size 消息在应答载荷中的编码长度, 含列表分隔符
+func (m *HistoryMessage) size() int { return encodedSize(m) }
+
+// truncate 截断消息内容使编码长度不超过max
+func (m *HistoryMessage) truncate(max int) {
+	m.Truncated = true
+	truncate(&m.Body, max, m.size)
+}
+
+// History 历史消息应答载荷, Messages按ID升序
+type History struct {
+	Room     int              `json:"room"`
+	Messages []HistoryMessage `json:"messages"`
+	More     bool             `json:"more"` // More 是否还有更早的消息
+}
+
+// Before 下一页的游标, 即本页最早的消息ID; 没有更早的消息时为0
+func (h *History) Before() uint64 {
+	if !h.More || len(h.Messages) == 0 {
+		return 0
+	}
+	return h.Messages[0].ID
+}
+
+func (h *History) String() string {
+	ret := fmt.Sprintf("\n房间%d历史消息:", h.Room)
+	for _, m := range h.Messages {
+		ret += fmt.Sprintf("\n#%d %s [%s]: %s", m.ID, m.Time.Format("2006-01-02 15:04:05"), m.From, m.Body)
+		if m.Truncated {
+			ret += "...(已截断)"
+		}
+	}
+	if before := h.Before(); before != 0 {
+		ret += fmt.Sprintf("\n更早的消息: /history %d %d", h.Room, before)
+	}
+	return ret
 }
 
-// UserCount 房间用户数
+// Leave 连接cid离开房间, 用户的最后一个连接离开时向房间内其他连接广播离开通知
+func (r *Room) Leave(cid string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if m, ok := r.users[cid]; ok {
+		delete(r.users, cid)
+		r.left(m.name)
+		if len(r.users) == 0 && r.empty != nil {
+			go r.empty(r)
+		}
+	}
+}
+
+// SetOnEmpty 设置最后一个连接离开后的回调, 用于释放临时房间
+func (r *Room) SetOnEmpty(f func(r *Room)) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.empty = f
+}
+
+// Close 释放房间, 此后不能再进入; 房间内仍有连接或消息尚未写完时返回false
+func (r *Room) Close() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.closed || r.saving || len(r.users) > 0 {
+		return false
+	}
+	r.closed = true
+	return true
+}
+
+// Members 房间成员, 同一用户的多个连接合并, 按用户名排序, 返回用户名在after之后的成员, after为空时从头开始.
+// 应答不超过MaxFrameSize, 超出时返回较少的成员, 其余经游标继续查询
+func (r *Room) Members(after string) *RoomMembers {
+	now := time.Now()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	merged := make(map[string]*Member, len(r.users))
+	for _, m := range r.users {
+		v, ok := merged[m.name]
+		if !ok {
+			v = &Member{Name: m.name, JoinedAt: m.joinedAt, activeAt: m.activeAt}
+			merged[m.name] = v
+		}
+		v.Devices++
+		if m.joinedAt.Before(v.JoinedAt) {
+			v.JoinedAt = m.joinedAt
+		}
+		if m.activeAt.After(v.activeAt) {
+			v.activeAt = m.activeAt
+		}
+	}
+	all := make([]Member, 0, len(merged))
+	for _, v := range merged {
+		if v.Name > after {
+			v.Idle = int64(now.Sub(v.activeAt) / time.Second)
+			all = append(all, *v)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+
+	ret := &RoomMembers{Room: r.Id, Members: make([]Member, 0, len(all)), Total: len(merged)}
+	budget := pageBudget(r.conf.MaxFrameSize)
+	for _, m := range all {
+		size := encodedSize(&m)
+		if size > budget && len(ret.Members) > 0 {
+			ret.More = true
+			break
+		}
+		budget -= size
+		ret.Members = append(ret.Members, m)
+	}
+	return ret
+}
+
+// Member 房间成员
+type Member struct {
+	Name     string    `json:"name"`
+	Devices  int       `json:"devices"`  // Devices 在房间内的连接数
+	JoinedAt time.Time `json:"joinedAt"` // JoinedAt 最早进入房间的时间
+	Idle     int64     `json:"idle"`     // Idle 最后一次发言或进入房间至今的秒数
+	activeAt time.Time
+}
+
+// RoomMembers 房间成员应答载荷, Members按用户名升序
+type RoomMembers struct {
+	Room    int      `json:"room"`
+	Members []Member `json:"members"`
+	Total   int      `json:"total"` // Total 房间在线用户数
+	More    bool     `json:"more"`  // More 是否还有用户名更大的成员
+}
+
+// After 下一页的游标, 即本页最后一个用户名; 没有更多成员时为空
+func (rm *RoomMembers) After() string {
+	if !rm.More || len(rm.Members) == 0 {
+		return ""
+	}
+	return rm.Members[len(rm.Members)-1].Name
+}
+
+func (rm *RoomMembers) String() string {
+	ret := fmt.Sprintf("\n房间%d在线用户(%d):", rm.Room, rm.Total)
+	for _, m := range rm.Members {
+		ret += fmt.Sprintf("\n%-16s 空闲: %s", m.Name, time.Duration(m.Idle)*time.Second)
+		if m.Devices > 1 {
+			ret += fmt.Sprintf(" 设备: %d", m.Devices)
+		}
+	}
+	if after := rm.After(); after != "" {
+		ret += fmt.Sprintf("\n下一页: /who %d %s", rm.Room, after)
+	}
+	return ret
+}
+
+// Flush 等待已发布的消息被房间内用户全部取走并写入存储, 直到ctx结束
+func (r *Room) Flush(ctx context.Context) error {
+	for !r.flushed() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func (r *Room) flushed() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.saving {
+		return false
+	}
+	for _, m := range r.users {
+		if len(m.ch) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// UserCount 房间用户数, 同一用户的多个连接只计一次
 func (r *Room) UserCount() int {
 	r.mtx.Lock()
 	defer r.mtx.Unlock()
-	return len(r.users)
+	names := make(map[string]struct{}, len(r.users))
+	for _, m := range r.users {
+		names[m.name] = struct{}{}
+	}
+	return len(names)
 }
 
 // PopularWords 房间频率最高的词
 func (r *Room) PopularWords() PopularWords {
-	return r.pop.TopN(config.MaxRoomPopularWords)
+	return r.pop.TopN(r.conf.MaxRoomPopularWords)
 }
 
 type PopularWords []frequency_stat.KeyCountElement
 
-func (e PopularWords) String() string {
+func (e PopularWords) String() string { return e.Counts().String() }
+
+// Counts 热词快照, 用于应答载荷
+func (e PopularWords) Counts() WordCounts {
+	ret := make(WordCounts, 0, len(e))
+	for _, w := range e {
+		ret = append(ret, WordCount{Word: w.Word, Count: w.Count()})
+	}
+	return ret
+}
+
+// WordCount 热词应答载荷
+type WordCount struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
+
+type WordCounts []WordCount
+
+func (e WordCounts) String() string {
 	if len(e) == 0 {
 		return ""
 	}
 	ret := ""
 	for _, w := range e {
-		ret += fmt.Sprintf("\n%s: %d", w.Word, w.Count())
+		ret += fmt.Sprintf("\n%s: %d", w.Word, w.Count)
 	}
 	return ret
 }
 
-func (r *Room) String() string {
-	return fmt.Sprintf("\n房间号: %-3d 当前在线用户: %d\n", r.Id, r.UserCount())
+// Summary 房间信息快照, 用于应答载荷
+func (r *Room) Summary() *RoomSummary {
+	r.mtx.Lock()
+	meta, dropped, evicted := r.meta, r.dropped, r.evicted
+	r.mtx.Unlock()
+	return &RoomSummary{ID: r.Id, RoomMeta: meta, UserCount: r.UserCount(), Dropped: dropped, Evicted: evicted}
 }
+
+func (r *Room) String() string { return r.Summary().String() }
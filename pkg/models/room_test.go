@@ -0,0 +1,326 @@
+package models_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoomQueuePolicy(t *testing.T) {
+	conf := config.Current()
+	conf.RoomQueueSize, conf.QuietRooms = 2, "1"
+
+	cases := []struct {
+		policy string
+		bodies []string
+		closed bool
+	}{
+		{models.QueueDropOldest, []string{"2", "3"}, false},
+		{models.QueueDropNewest, []string{"1", "2"}, false},
+		{models.QueueDisconnect, []string{"1", "2"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			tt := require.New(t)
+			conf.RoomQueuePolicy = c.policy
+
+			r := models.NewRoom(1, nil, conf)
+			_, slow, _ := r.Entry("c1", "c1", "bob", nil)
+			_, idle, _ := r.Entry("c2", "c2", "carol", nil)
+			// 发布不因队列已满而阻塞
+			for i := 1; i <= 3; i++ {
+				r.Pub(protoc.NewEcho(protoc.Seq(i), "alice", fmt.Sprint(i)), "c0")
+				if i < 3 {
+					<-idle
+				}
+			}
+
+			for _, body := range c.bodies {
+				tt.Equal(body, (<-slow).(*protoc.Echo).Body)
+			}
+			_, ok := <-idle
+			tt.True(ok)
+			select {
+			case _, ok = <-slow:
+				tt.Equal(c.closed, !ok)
+			default:
+				tt.False(c.closed)
+			}
+
+			s := r.Summary()
+			tt.Equal(uint64(1), s.Dropped)
+			if c.closed {
+				tt.Equal(1, s.Evicted)
+				tt.Equal(1, s.UserCount)
+			} else {
+				tt.Equal(0, s.Evicted)
+				tt.Equal(2, s.UserCount)
+			}
+		})
+	}
+}
+
+func TestRoomPresence(t *testing.T) {
+	tt := require.New(t)
+
+	conf := config.Current()
+	conf.QuietRooms = "2"
+
+	r := models.NewRoom(1, nil, conf)
+	_, bob, _ := r.Entry("c1", "c1", "bob", nil)
+	_, _, _ = r.Entry("c2", "c2", "carol", nil)
+	n := (<-bob).(*protoc.Notice)
+	tt.Equal(protoc.NoticeJoin, n.Kind)
+	tt.Contains(n.Body, "carol")
+
+	// 同一用户的其他连接进出不重复通知
+	_, _, _ = r.Entry("c3", "c3", "carol", nil)
+	r.Pub(protoc.NewEcho(1, "carol", "hi"), "c3")
+	r.Leave("c3")
+	tt.Equal("hi", (<-bob).(*protoc.Echo).Body)
+
+	members := r.Members("")
+	tt.Len(members.Members, 2)
+	tt.Equal("bob", members.Members[0].Name)
+	tt.Equal(1, members.Members[1].Devices)
+
+	r.Leave("c2")
+	tt.Equal(protoc.NoticeLeave, (<-bob).(*protoc.Notice).Kind)
+	tt.Len(bob, 0)
+
+	quiet := models.NewRoom(2, nil, conf)
+	_, bob, _ = quiet.Entry("c1", "c1", "bob", nil)
+	_, _, _ = quiet.Entry("c2", "c2", "carol", nil)
+	quiet.Leave("c2")
+	tt.Len(bob, 0)
+
+	// 按房间名配置
+	conf.QuietRooms = "lobby"
+	named := models.NewRoom(3, nil, conf)
+	named.SetMeta(models.RoomMeta{Name: "lobby"})
+	_, bob, _ = named.Entry("c1", "c1", "bob", nil)
+	_, _, _ = named.Entry("c2", "c2", "carol", nil)
+	named.Leave("c2")
+	tt.Len(bob, 0)
+}
+
+func TestRoomNoticeLabel(t *testing.T) {
+	tt := require.New(t)
+
+	// 有房间名的房间在通知中使用房间名, 否则使用房间号
+	r := models.NewRoom(7, nil, nil)
+	r.SetMeta(models.RoomMeta{Name: "lobby", Creator: "bob"})
+	_, bob, _ := r.Entry("c1", "c1", "bob", nil)
+	_, _, _ = r.Entry("c2", "c2", "carol", nil)
+	tt.Equal("carol 进入了房间lobby", (<-bob).(*protoc.Notice).Body)
+	tt.NoError(r.SetTopic("go", "bob"))
+	tt.Equal("bob 将房间lobby的话题修改为: go", (<-bob).(*protoc.Notice).Body)
+
+	r = models.NewRoom(8, nil, nil)
+	_, bob, _ = r.Entry("c1", "c1", "bob", nil)
+	_, _, _ = r.Entry("c2", "c2", "carol", nil)
+	tt.Equal("carol 进入了房间8", (<-bob).(*protoc.Notice).Body)
+}
+
+func TestRoomEntryOrigin(t *testing.T) {
+	tt := require.New(t)
+
+	r := models.NewRoom(1, nil, nil)
+	_, _, err := r.Entry("c1", "s1", "alice", nil)
+	tt.NoError(err)
+	r.Pub(protoc.NewEcho(1, "alice", "from laptop"), "c1")
+	r.Leave("c1")
+
+	// 同一会话在新连接上进入时不再返回其发布的消息, 同一用户的其他会话照常返回
+	cache, _, err := r.Entry("c2", "s1", "alice", nil)
+	tt.NoError(err)
+	tt.Empty(cache)
+	cache, _, err = r.Entry("c3", "s2", "alice", nil)
+	tt.NoError(err)
+	tt.Len(cache, 1)
+	tt.Equal("from laptop", cache[0].Body)
+}
+
+func TestRoomHistorySize(t *testing.T) {
+	tt := require.New(t)
+
+	r := models.NewRoom(1, nil, nil)
+	for i := 0; i < 100; i++ {
+		r.Pub(protoc.NewEcho(protoc.Seq(i), "alice", strings.Repeat("x", 1024)), "c0")
+	}
+
+	// 每页应答不超过单帧最大长度, 经游标可取回全部消息
+	var (
+		before uint64
+		total  int
+		pages  int
+	)
+	for {
+		h := r.History(before, models.MaxHistoryLimit)
+		tt.True(models.NewResponse(1, h).Len <= config.MaxFrameSize)
+		total += len(h.Messages)
+		pages++
+		if before = h.Before(); before == 0 {
+			break
+		}
+	}
+	tt.Equal(100, total)
+	tt.True(pages > 1)
+
+	// 单条消息超出时截断内容
+	r.Pub(protoc.NewEcho(1, "alice", strings.Repeat("<", int(config.MaxFrameSize))), "c0")
+	h := r.History(0, models.MaxHistoryLimit)
+	tt.True(models.NewResponse(1, h).Len <= config.MaxFrameSize)
+	tt.Len(h.Messages, 1)
+	tt.True(h.Messages[0].Truncated)
+	tt.True(h.More)
+}
+
+func TestRoomHistorySmallFrame(t *testing.T) {
+	tt := require.New(t)
+
+	// 单帧最大长度小于预留长度时不截断越界, 消息内容截断为空
+	conf := config.Current()
+	conf.MaxFrameSize = 256
+
+	r := models.NewRoom(1, nil, conf)
+	r.Pub(protoc.NewEcho(1, "alice", strings.Repeat("x", 1024)), "c0")
+	r.Pub(protoc.NewEcho(2, "alice", "hello"), "c0")
+	h := r.History(0, models.MaxHistoryLimit)
+	tt.Len(h.Messages, 1)
+	tt.True(h.Messages[0].Truncated)
+	tt.Empty(h.Messages[0].Body)
+	tt.True(h.More)
+}
+
+func TestRoomMembersSize(t *testing.T) {
+	tt := require.New(t)
+
+	conf := config.Current()
+	conf.MaxFrameSize = config.MinFrameSize
+
+	r := models.NewRoom(1, nil, conf)
+	for i := 0; i < 20; i++ {
+		_, _, _ = r.Entry(fmt.Sprintf("c%d", i), fmt.Sprintf("c%d", i), fmt.Sprintf("user%02d", i), nil)
+	}
+
+	// 每页应答不超过单帧最大长度, 经游标按用户名顺序取回全部成员
+	var (
+		after string
+		names []string
+		pages int
+	)
+	for {
+		members := r.Members(after)
+		tt.True(models.NewResponse(1, members).Len <= conf.MaxFrameSize)
+		tt.Equal(20, members.Total)
+		for _, m := range members.Members {
+			names = append(names, m.Name)
+		}
+		pages++
+		if after = members.After(); after == "" {
+			break
+		}
+	}
+	tt.Len(names, 20)
+	tt.Equal("user00", names[0])
+	tt.Equal("user19", names[19])
+	tt.True(pages > 1)
+}
+
+func TestRoomPageSize(t *testing.T) {
+	tt := require.New(t)
+
+	var summaries []models.RoomSummary
+	for i := 1; i <= models.MaxRoomListLimit; i++ {
+		summaries = append(summaries, models.RoomSummary{
+			ID:       i,
+			RoomMeta: models.RoomMeta{Topic: strings.Repeat("t", 1024), Description: strings.Repeat("d", 1024)},
+		})
+	}
+
+	// 超出单帧最大长度时只保留靠前的房间, 下一页从其后的房间号开始
+	page := models.NewRoomPage(summaries, len(summaries), false, config.MaxFrameSize)
+	tt.True(models.NewResponse(1, page).Len <= config.MaxFrameSize)
+	tt.True(len(page.Rooms) < len(summaries))
+	tt.True(page.More)
+	tt.Equal(page.Rooms[len(page.Rooms)-1].ID+1, page.Next())
+
+	// 单个房间即超出时截断简介及话题
+	summaries[0].Description = strings.Repeat("<", int(config.MaxFrameSize))
+	page = models.NewRoomPage(summaries[:1], 1, false, config.MaxFrameSize)
+	tt.True(models.NewResponse(1, page).Len <= config.MaxFrameSize)
+	tt.Len(page.Rooms, 1)
+	tt.True(page.Rooms[0].Truncated)
+	tt.False(page.More)
+	tt.Equal(0, page.Next())
+}
+
+// slowStore 写入阻塞直到release关闭
+type slowStore struct {
+	release chan struct{}
+	saved   chan uint64
+}
+
+func (s *slowStore) AppendMessage(_ int, msg *protoc.Echo) error {
+	<-s.release
+	s.saved <- msg.MsgID
+	return nil
+}
+
+func TestRoomSlowStore(t *testing.T) {
+	tt := require.New(t)
+
+	conf := config.Current()
+	conf.QuietRooms = "1"
+
+	s := &slowStore{release: make(chan struct{}), saved: make(chan uint64, 3)}
+	r := models.NewRoom(1, nil, conf)
+	r.SetStore(s)
+	_, ch, _ := r.Entry("c1", "c1", "bob", nil)
+
+	// 存储阻塞时发布及投递不受影响, Flush等待消息写入
+	for i := 1; i <= 3; i++ {
+		r.Pub(protoc.NewEcho(protoc.Seq(i), "alice", fmt.Sprint(i)), "c0")
+		tt.Equal(uint64(i), (<-ch).(*protoc.Echo).MsgID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tt.Error(r.Flush(ctx))
+
+	close(s.release)
+	tt.NoError(r.Flush(context.Background()))
+	for i := 1; i <= 3; i++ {
+		tt.Equal(uint64(i), <-s.saved)
+	}
+}
+
+func TestRoomEntryResume(t *testing.T) {
+	tt := require.New(t)
+
+	r := models.NewRoom(1, nil, nil)
+	for _, name := range []string{"alice", "bob", "alice"} {
+		r.Pub(protoc.NewEcho(1, name, "hi from "+name), "s-"+name)
+	}
+
+	// 续传标记为消息ID, 发送者不同而序列号相同的消息不会被误认为标记
+	cache, _, err := r.Entry("c1", "s-carol", "carol", nil)
+	tt.NoError(err)
+	tt.Len(cache, 3)
+	cache, _, err = r.Entry("c2", "s-carol", "carol", protoc.NewResume(cache[0]))
+	tt.NoError(err)
+	tt.Len(cache, 2)
+	tt.Equal("bob", cache[0].From)
+
+	// 标记超出已分配的消息ID时无效, 返回全部缓存
+	cache, _, err = r.Entry("c3", "s-carol", "carol", &protoc.Resume{MsgID: 100})
+	tt.NoError(err)
+	tt.Len(cache, 3)
+}
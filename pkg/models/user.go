@@ -9,6 +9,7 @@ import (
 
 	"github.com/saitofun/chat/pkg/depends/protoc"
 	"github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/qlib/net/qmsg"
 	"github.com/saitofun/qlib/net/qsock"
 )
 
@@ -17,6 +18,9 @@ type User struct {
 	CreatedAt time.Time `json:"createdAt"` // CreatedAt when user created
 	LastLogin time.Time `json:"lastLogin"` // LastLogin user last login at
 	LogoffAt  time.Time `json:"logoffAt"`  // LogoffAt user logoff
+
+	PasswordHash string  `json:"passwordHash,omitempty"` // PasswordHash bcrypt哈希, 为空表示未设置密码
+	Mailbox      []*Mail `json:"mailbox,omitempty"`      // Mailbox 离线期间收到的消息, 最多保留MaxMailboxSize条
 }
 
 func (u User) OnlineDuration() time.Duration {
@@ -29,15 +33,17 @@ func (u User) OnlineDuration() time.Duration {
 
 type UserInfo struct {
 	*User
-	room   *Room
-	node   *qsock.Node
-	mtx    *sync.Mutex
-	ctx    context.Context
-	cancel context.CancelFunc
+	room    *Room
+	node    *qsock.Node
+	caps    protoc.Capability // caps 连接协商的能力集
+	session *Session          // session 连接绑定的登录会话
+	mtx     *sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
 }
 
+// NewUserInfo 用户在连接node上的登录, 登录及下线时间由调用方维护
 func NewUserInfo(user *User, node *qsock.Node) *UserInfo {
-	user.LastLogin = time.Now()
 	return &UserInfo{
 		User: user,
 		room: nil,
@@ -46,73 +52,150 @@ func NewUserInfo(user *User, node *qsock.Node) *UserInfo {
 	}
 }
 
+// Node 用户所在连接
+func (u *UserInfo) Node() *qsock.Node { return u.node }
+
+// SetSession 绑定登录会话
+func (u *UserInfo) SetSession(session *Session) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.session = session
+}
+
+// Session 连接绑定的登录会话, 未绑定返回nil
+func (u *UserInfo) Session() *Session {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.session
+}
+
+// SetCaps 设置连接协商的能力集, 决定推送的房间消息格式
+func (u *UserInfo) SetCaps(caps protoc.Capability) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.caps = caps
+}
+
 func (u *UserInfo) Pub(msg *protoc.Echo) error {
 	u.mtx.Lock()
 	defer u.mtx.Unlock()
 	if u.room == nil {
 		return errors.ErrNotEnterRoom
 	}
-	u.room.Pub(msg)
+	u.room.Pub(msg, u.node.ID())
 	return nil
 }
 
-func (u *UserInfo) EntryRoom(room *Room) {
+// origin 连接发布消息的来源标识, 即登录会话标识, 未绑定会话时为连接标识; 调用方持有u.mtx
+func (u *UserInfo) origin() string {
+	if u.session != nil && u.session.ID != "" {
+		return u.session.ID
+	}
+	return u.node.ID()
+}
+
+// Direct 向连接推送私信, 未协商CapDirect的连接以回显消息推送
+func (u *UserInfo) Direct(msg *protoc.Direct) error {
+	u.mtx.Lock()
+	caps := u.caps
+	u.mtx.Unlock()
+
+	if caps.Has(protoc.CapDirect) {
+		return u.node.SendMessage(msg)
+	}
+	return u.node.SendMessage(msg.Echo())
+}
+
+// Room 当前所在房间, 未进入房间返回nil
+func (u *UserInfo) Room() *Room {
 	u.mtx.Lock()
 	defer u.mtx.Unlock()
+	return u.room
+}
 
+// EntryRoom 进入房间, resume为断线续传标记, 可为nil; 进入成功后离开之前的房间, 失败时仍留在之前的房间
+func (u *UserInfo) EntryRoom(room *Room, resume *protoc.Resume) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	cache, ch, err := room.Entry(u.node.ID(), u.origin(), u.Name, resume)
+	if err != nil {
+		return err
+	}
 	if u.cancel != nil {
 		u.cancel()
 	}
-	if u.room != nil {
-		u.room.Leave(u.Name)
+	if u.room != nil && u.room != room {
+		u.room.Leave(u.node.ID())
 	}
 	u.room = room
 	u.ctx, u.cancel = context.WithCancel(context.Background())
-	go u.consuming()
+	go u.consuming(u.ctx, cache, ch, u.caps)
+	return nil
 }
 
 func (u *UserInfo) Leave() {
 	u.mtx.Lock()
 	defer u.mtx.Unlock()
 	if u.room != nil {
-		u.room.Leave(u.Name)
+		u.room.Leave(u.node.ID())
 	}
 }
 
+// Logoff 下线并断开连接, 下线时间由调用方维护
 func (u *UserInfo) Logoff() {
+	u.Detach()
+	u.node.Stop()
+}
+
+// Detach 停止接收房间消息并离开房间, 连接保留可重新登录
+func (u *UserInfo) Detach() {
 	u.mtx.Lock()
 	defer u.mtx.Unlock()
 
-	u.node.Stop()
-	u.LogoffAt = time.Now()
 	if u.cancel != nil {
 		u.cancel()
 	}
 	if u.room != nil {
-		u.room.Leave(u.Name)
+		u.room.Leave(u.node.ID())
 	}
 }
 
-func (u *UserInfo) consuming() {
-	cache, ch := u.room.Entry(u.Name)
-	for _, msg := range cache {
-		if msg.From == u.Name {
-			continue
+// consuming 推送进入房间时的历史消息cache, 随后消费房间队列ch直到ctx结束; cache已由Room.Entry排除本会话发布的消息.
+// 订阅由EntryRoom持锁完成, 连续切换房间时已离开的房间不会残留订阅
+func (u *UserInfo) consuming(ctx context.Context, cache []*protoc.Echo, ch <-chan qmsg.Message, caps protoc.Capability) {
+	write := func(msg qmsg.Message) error {
+		switch m := msg.(type) {
+		case *protoc.Echo:
+			if !caps.Has(protoc.CapMessageID) {
+				msg = m.WithoutMeta()
+			} else if !caps.Has(protoc.CapMention) {
+				msg = m.WithoutMentions()
+			}
+		case *protoc.Notice:
+			if !caps.Has(protoc.CapNotice) {
+				msg = m.Echo()
+			}
 		}
-		if err := u.node.WriteMessage(msg); err != nil {
+		return u.node.WriteMessage(msg)
+	}
+	for _, msg := range cache {
+		if err := write(msg); err != nil {
 			u.Logoff()
 			return
 		}
 	}
 	for {
 		select {
-		case <-u.ctx.Done():
+		case <-ctx.Done():
 			return
-		case msg := <-ch:
-			if msg.From == u.Name {
-				continue
+		case msg, ok := <-ch:
+			// 队列被关闭: 消费过慢, 断开连接
+			if !ok {
+				u.Logoff()
+				return
 			}
-			if err := u.node.WriteMessage(msg); err != nil {
+			if err := write(msg); err != nil {
 				u.Logoff()
 				return
 			}
@@ -120,19 +203,84 @@ func (u *UserInfo) consuming() {
 	}
 }
 
-func (u *UserInfo) String() string {
+// Profile 离线用户信息快照, 用于应答载荷; LastLogin等由users.Manager在其锁内修改, 调用方须持有该锁,
+// 见users.Manager.Profile
+func (u *User) Profile() *UserProfile {
+	return &UserProfile{
+		Name:           u.Name,
+		CreatedAt:      u.CreatedAt,
+		LastLogin:      u.LastLogin,
+		OnlineDuration: u.OnlineDuration(),
+	}
+}
+
+// Profile 用户信息快照, 用于应答载荷; 调用方须持有users.Manager的锁, 同User.Profile
+func (u *UserInfo) Profile() *UserProfile {
 	u.mtx.Lock()
-	room := "未进入房间"
+	room := 0
 	if u.room != nil {
-		room = strconv.Itoa(u.room.Id)
+		room = u.room.Id
 	}
 	u.mtx.Unlock()
 
-	du := u.OnlineDuration()
+	return &UserProfile{
+		Name:           u.Name,
+		CreatedAt:      u.CreatedAt,
+		LastLogin:      u.LastLogin,
+		Room:           room,
+		OnlineDuration: u.OnlineDuration(),
+	}
+}
+
+// SessionProfile 携带登录会话的用户信息快照, 仅用于登录及恢复会话的应答; 调用方须持有users.Manager的锁,
+// 见users.Manager.SessionProfile
+func (u *UserInfo) SessionProfile() *UserProfile {
+	p := u.Profile()
+	p.Session = u.Session()
+	return p
+}
+
+// UserProfile 用户信息应答载荷
+type UserProfile struct {
+	Name           string        `json:"name"`
+	CreatedAt      time.Time     `json:"createdAt"`
+	LastLogin      time.Time     `json:"lastLogin"`
+	Room           int           `json:"room"` // Room 所在房间, 0表示未进入房间
+	OnlineDuration time.Duration `json:"onlineDuration"`
+	Devices        int           `json:"devices,omitempty"` // Devices 在线连接数
+	Session        *Session      `json:"session,omitempty"` // Session 登录会话, 仅登录及恢复会话的应答携带
+}
+
+// Session 登录会话, 令牌用于在新连接上恢复登录
+type Session struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	ID        string    `json:"-"` // ID 会话标识, 恢复会话后不变; 不同于令牌, 不随应答下发
+}
 
+func (p *UserProfile) String() string {
+	room := "未进入房间"
+	if p.Room != 0 {
+		room = strconv.Itoa(p.Room)
+	}
 	return fmt.Sprintf("\n用户名: %s\n"+
 		"登陆时间: %s\n"+
 		"所在房间: %s\n"+
-		"在线时长: %s\n", u.Name, u.LastLogin.Format("2006-01-02 15:04:05"),
-		room, du.String())
+		"在线时长: %s\n", p.Name, p.LastLogin.Format("2006-01-02 15:04:05"),
+		room, p.OnlineDuration.String()) + p.devices() + p.Session.String()
+}
+
+func (p *UserProfile) devices() string {
+	if p.Devices <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("在线设备: %d\n", p.Devices)
+}
+
+func (s *Session) String() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("会话令牌: %s\n"+
+		"有效期至: %s\n", s.Token, s.ExpiresAt.Format("2006-01-02 15:04:05"))
 }
@@ -2,42 +2,59 @@ package profanity_words
 
 import (
 	"bufio"
+	"errors"
 	"io"
-	"log"
 	"os"
+	"sync"
 
-	"github.com/saitofun/chat/cmd/config"
 	"github.com/saitofun/chat/pkg/depends/alg/trie"
 	"github.com/saitofun/chat/pkg/depends/util"
 )
 
-var root *trie.Root
+// Filter 敏感词过滤器, 词库为空时不过滤
+type Filter struct {
+	root *trie.Root
+	mtx  *sync.RWMutex
+}
+
+func NewFilter(words ...string) *Filter {
+	return &Filter{root: trie.NewRoot(words...), mtx: &sync.RWMutex{}}
+}
 
-func init() {
-	err := util.DownloadFile(
-		config.RemoteProfanityWordsURL, config.LocalProfanityWordsPath,
-	)
-	if err != nil && !util.IsExist(config.LocalProfanityWordsPath) {
-		log.Fatal("profanity words filtering disabled, because no dict file")
+// Load 从url下载词库到path后加载, url为空或下载失败时加载path已有的词库
+func Load(url, path string) (*Filter, error) {
+	if url != "" {
+		_ = util.DownloadFile(url, path)
+	}
+	if !util.IsExist(path) {
+		return nil, ErrNoDictFile
 	}
-	if err = LoadDictFromFile(config.LocalProfanityWordsPath); err != nil {
-		log.Fatal("profanity words filtering disabled, because cannot load words")
+	f := NewFilter()
+	if err := f.LoadDictFromFile(path); err != nil {
+		return nil, err
 	}
+	return f, nil
 }
 
-func LoadDictByWords(words []string) {
-	root = trie.NewRoot(words...)
-	for _, word := range words {
-		root.Insert([]rune(word))
-	}
+var ErrNoDictFile = errors.New("no dict file")
+
+// Default 包级函数使用的过滤器
+var Default = NewFilter()
+
+func (f *Filter) LoadDictByWords(words []string) {
+	root := trie.NewRoot(words...)
+	f.mtx.Lock()
+	f.root = root
+	f.mtx.Unlock()
 }
 
-func LoadDictFromFile(path string) error {
-	f, err := os.Open(path)
+func (f *Filter) LoadDictFromFile(path string) error {
+	fl, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	reader := bufio.NewReader(f)
+	defer fl.Close()
+	reader := bufio.NewReader(fl)
 	words := make([]string, 0)
 	for {
 		line, _, err := reader.ReadLine()
@@ -49,12 +66,15 @@ func LoadDictFromFile(path string) error {
 		}
 		words = append(words, string(line))
 	}
-	LoadDictByWords(words)
+	f.LoadDictByWords(words)
 	return nil
 }
 
-func MaskWordsBy(src string, replacer rune) string {
-	matched := root.ScanSentence(src)
+func (f *Filter) MaskWordsBy(src string, replacer rune) string {
+	f.mtx.RLock()
+	matched := f.root.ScanSentence(src)
+	f.mtx.RUnlock()
+
 	sentence := []rune(src)
 	for _, pair := range matched {
 		for idx := pair[0]; idx < pair[1]; idx++ {
@@ -64,8 +84,11 @@ func MaskWordsBy(src string, replacer rune) string {
 	return string(sentence)
 }
 
-func MatchedWords(src string) []string {
-	matched := root.ScanSentence(src)
+func (f *Filter) MatchedWords(src string) []string {
+	f.mtx.RLock()
+	matched := f.root.ScanSentence(src)
+	f.mtx.RUnlock()
+
 	sentence := []rune(src)
 	ret := make([]string, 0, len(matched))
 	for _, pair := range matched {
@@ -74,8 +97,20 @@ func MatchedWords(src string) []string {
 	return ret
 }
 
-func AddWords(words ...string) {
+func (f *Filter) AddWords(words ...string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
 	for _, word := range words {
-		root.Insert([]rune(word))
+		f.root.Insert([]rune(word))
 	}
 }
+
+func LoadDictByWords(words []string) { Default.LoadDictByWords(words) }
+
+func LoadDictFromFile(path string) error { return Default.LoadDictFromFile(path) }
+
+func MaskWordsBy(src string, replacer rune) string { return Default.MaskWordsBy(src, replacer) }
+
+func MatchedWords(src string) []string { return Default.MatchedWords(src) }
+
+func AddWords(words ...string) { Default.AddWords(words...) }
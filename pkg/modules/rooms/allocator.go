@@ -0,0 +1,27 @@
+package rooms
+
+import "github.com/saitofun/chat/pkg/models"
+
+// allocator 房间号分配器, 调用方持有Manager.mtx
+type allocator struct {
+	reuse bool // reuse 取最小的未使用房间号, 否则在last上递增, 已使用过的房间号不再分配
+	last  int  // last 已使用的最大房间号
+}
+
+// use 记录已使用的房间号, 包括指定房间号创建及恢复的房间
+func (a *allocator) use(id int) {
+	if id > a.last {
+		a.last = id
+	}
+}
+
+// next 分配新的房间号, rooms为当前全部房间
+func (a *allocator) next(rooms map[int]*models.Room) int {
+	id := a.last + 1
+	if a.reuse {
+		for id = 1; rooms[id] != nil; id++ {
+		}
+	}
+	a.use(id)
+	return id
+}
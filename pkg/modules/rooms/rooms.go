@@ -1,57 +1,254 @@
 package rooms
 
 import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/errors"
 	"github.com/saitofun/chat/pkg/models"
+	"github.com/saitofun/chat/pkg/modules/profanity_words"
+	"github.com/saitofun/chat/pkg/modules/store"
 )
 
-type mgr struct {
-	Rooms map[int]*models.Room
-	mtx   *sync.Mutex
-	idx   int
+// Manager 房间管理
+type Manager struct {
+	Rooms  map[int]*models.Room
+	names  map[string]*models.Room // names 房间名索引
+	filter *profanity_words.Filter
+	store  store.Store // store 持久化存储, 为nil不持久化
+	conf   *config.Settings
+	mtx    *sync.Mutex
+	ids    *allocator
 }
 
-var c = &mgr{
-	Rooms: make(map[int]*models.Room),
-	mtx:   &sync.Mutex{},
-	idx:   1,
+// New 创建房间管理, 房间内消息经filter过滤敏感词, filter为nil时不过滤;
+// reuse为true时新建房间取最小的未使用房间号, 包括已释放的临时房间, 否则在已使用的最大房间号上递增;
+// conf为nil时使用当前全局配置
+func New(filter *profanity_words.Filter, reuse bool, conf *config.Settings) *Manager {
+	if conf == nil {
+		conf = config.Current()
+	}
+	return &Manager{
+		Rooms:  make(map[int]*models.Room),
+		names:  make(map[string]*models.Room),
+		filter: filter,
+		conf:   conf,
+		mtx:    &sync.Mutex{},
+		ids:    &allocator{reuse: reuse},
+	}
 }
 
-func Controller() *mgr { return c }
-
-func (m *mgr) GetByID(id int) *models.Room {
+func (m *Manager) GetByID(id int) *models.Room {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 	return m.Rooms[id]
 }
 
-func (m *mgr) CreateRoom(id int) (*models.Room, error) {
+// GetByName 按房间名查找房间, 房间名大小写不敏感
+func (m *Manager) GetByName(name string) *models.Room {
+	name, err := models.ParseRoomName(name)
+	if err != nil {
+		return nil
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.names[name]
+}
+
+// Lookup 按房间号或房间名查找房间, 全为数字时视为房间号
+func (m *Manager) Lookup(room string) *models.Room {
+	if id, err := strconv.Atoi(room); err == nil {
+		return m.GetByID(id)
+	}
+	return m.GetByName(room)
+}
+
+// CreateRoom 以房间号id创建无名房间, 已存在时返回该房间; id为0时分配新的房间号
+func (m *Manager) CreateRoom(id int) (*models.Room, error) {
+	if id < 0 {
+		return nil, errors.ErrInvalidRoomID
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 	if id == 0 {
-		for i := 1; ; i++ {
-			if _, ok := m.Rooms[i]; !ok {
-				id = i
-			}
-		}
-	} else {
-		if r, ok := m.Rooms[id]; ok {
-			return r, nil
+		id = m.ids.next(m.Rooms)
+	} else if r, ok := m.Rooms[id]; ok {
+		return r, nil
+	}
+	ret := models.NewRoom(id, m.filter, m.conf)
+	m.add(ret)
+	return ret, nil
+}
+
+// Create 用户creator创建名为name的房间并分配房间号, name为空时创建无名房间; 房间名已存在返回ErrRoomNameExists
+func (m *Manager) Create(name, creator, description string) (*models.Room, error) {
+	if name != "" {
+		var err error
+		if name, err = models.ParseRoomName(name); err != nil {
+			return nil, err
 		}
 	}
-	ret := models.NewRoom(id)
-	m.Rooms[id] = ret
-	m.idx++
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.names[name]; ok && name != "" {
+		return nil, errors.ErrRoomNameExists
+	}
+	id := m.ids.next(m.Rooms)
+	ret := models.NewRoom(id, m.filter, m.conf)
+	ret.SetMeta(models.RoomMeta{
+		Name:        name,
+		Description: description,
+		Creator:     creator,
+		CreatedAt:   time.Now(),
+	})
+	m.add(ret)
 	return ret, nil
 }
 
-func (m *mgr) RoomList() (ret models.Rooms) {
+// SetTopic 用户name修改房间r的话题并保存
+func (m *Manager) SetTopic(r *models.Room, topic, name string) error {
+	if err := r.SetTopic(topic, name); err != nil {
+		return err
+	}
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
+	m.save(r)
+	return nil
+}
 
-	for _, v := range m.Rooms {
-		ret = append(ret, *v)
+// add 添加并保存新建的房间, 临时房间在最后一个连接离开后释放; 调用方持有m.mtx
+func (m *Manager) add(r *models.Room) {
+	if m.store != nil {
+		r.SetStore(m.store)
+	}
+	m.ids.use(r.Id)
+	m.Rooms[r.Id] = r
+	meta := r.Meta()
+	if meta.Name != "" {
+		m.names[meta.Name] = r
+	}
+	if meta.Temporary() {
+		r.SetOnEmpty(m.release)
+	}
+	m.save(r)
+}
+
+// release 释放已无连接的临时房间并删除其消息, 房间号按分配策略可再次分配; 释放前有连接重新进入时保留
+func (m *Manager) release(r *models.Room) {
+	// 等待已发布的消息写完, 避免删除后再写入该房间
+	_ = r.Flush(context.Background())
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.Rooms[r.Id] != r || !r.Close() {
+		return
+	}
+	delete(m.Rooms, r.Id)
+	if m.store != nil {
+		if err := m.store.DeleteRoom(r.Id); err != nil {
+			log.Printf("delete room %d: %v", r.Id, err)
+		}
+	}
+	log.Printf("room %d released", r.Id)
+}
+
+// save 持久化房间及元数据; 调用方持有m.mtx
+func (m *Manager) save(r *models.Room) {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.SaveRoom(r.Id, r.Meta()); err != nil {
+		log.Printf("save room %d: %v", r.Id, err)
+	}
+}
+
+// Restore 恢复d中保存的房间及消息, 此后新建的房间及房间消息写入s; 临时房间恢复时已无连接, 直接删除
+func (m *Manager) Restore(s store.Store, d *store.Data) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.store = s
+	for _, r := range m.Rooms {
+		r.SetStore(s)
+	}
+	m.ids.use(d.LastRoomID)
+	for _, saved := range d.Rooms {
+		if _, ok := m.Rooms[saved.ID]; ok {
+			continue
+		}
+		m.ids.use(saved.ID)
+		if saved.Meta.Temporary() {
+			if s != nil {
+				if err := s.DeleteRoom(saved.ID); err != nil {
+					log.Printf("delete room %d: %v", saved.ID, err)
+				}
+			}
+			continue
+		}
+		r := models.NewRoom(saved.ID, m.filter, m.conf)
+		r.SetMeta(saved.Meta)
+		r.Restore(saved.LastID, saved.Messages)
+		r.SetStore(s)
+		m.Rooms[saved.ID] = r
+		if saved.Meta.Name != "" {
+			m.names[saved.Meta.Name] = r
+		}
+	}
+}
+
+// RoomList 按房间号升序分页的房间列表, 从房间号from开始, limit为0时使用默认条数
+func (m *Manager) RoomList(from, limit int) *models.RoomPage {
+	if limit <= 0 {
+		limit = models.DefaultRoomListLimit
+	}
+	if limit > models.MaxRoomListLimit {
+		limit = models.MaxRoomListLimit
+	}
+
+	list := m.list()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	start := sort.Search(len(list), func(i int) bool { return list[i].Id >= from })
+	end := start + limit
+	if end > len(list) {
+		end = len(list)
+	}
+	summaries := make([]models.RoomSummary, 0, end-start)
+	for _, r := range list[start:end] {
+		summaries = append(summaries, *r.Summary())
+	}
+	return models.NewRoomPage(summaries, len(list), end < len(list), m.conf.MaxFrameSize)
+}
+
+// Flush 等待全部房间内待投递的消息写出, 直到ctx结束
+func (m *Manager) Flush(ctx context.Context) error {
+	for _, r := range m.list() {
+		if err := r.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mute 暂停或恢复全部房间的用户进出通知, 用于服务关闭时用户集中下线及重新启动
+func (m *Manager) Mute(muted bool) {
+	for _, r := range m.list() {
+		r.SetMuted(muted)
+	}
+}
+
+func (m *Manager) list() []*models.Room {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ret := make([]*models.Room, 0, len(m.Rooms))
+	for _, r := range m.Rooms {
+		ret = append(ret, r)
 	}
 	return ret
 }
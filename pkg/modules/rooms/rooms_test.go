@@ -0,0 +1,136 @@
+package rooms_test
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/saitofun/chat/pkg/modules/rooms"
+	"github.com/saitofun/chat/pkg/modules/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagerAllocate(t *testing.T) {
+	for _, reuse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reuse=%v", reuse), func(t *testing.T) {
+			tt := require.New(t)
+			m := rooms.New(nil, reuse, nil)
+
+			// 并发分配的房间号互不重复且连续; 协程内只收集结果, 等待全部结束后再断言
+			const n = 64
+			var (
+				wg   sync.WaitGroup
+				mtx  sync.Mutex
+				ids  []int
+				errs []error
+			)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					var (
+						r   *models.Room
+						err error
+					)
+					if i%2 == 0 {
+						r, err = m.CreateRoom(0)
+					} else {
+						r, err = m.Create(fmt.Sprintf("room-%d", i), "alice", "")
+					}
+					mtx.Lock()
+					defer mtx.Unlock()
+					if err != nil {
+						errs = append(errs, err)
+						return
+					}
+					ids = append(ids, r.Id)
+				}(i)
+			}
+			wg.Wait()
+			tt.Empty(errs)
+			tt.Len(ids, n)
+			sort.Ints(ids)
+			for i, id := range ids {
+				tt.Equal(i+1, id)
+			}
+			tt.Equal(n, m.RoomList(1, 1).Total)
+
+			// 指定房间号创建后留下空缺, 复用模式下优先分配空缺的房间号
+			_, err := m.CreateRoom(n + 2)
+			tt.NoError(err)
+			r, err := m.CreateRoom(0)
+			tt.NoError(err)
+			if reuse {
+				tt.Equal(n+1, r.Id)
+			} else {
+				tt.Equal(n+3, r.Id)
+			}
+		})
+	}
+}
+
+func TestManagerRelease(t *testing.T) {
+	for _, reuse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reuse=%v", reuse), func(t *testing.T) {
+			tt := require.New(t)
+			m := rooms.New(nil, reuse, nil)
+
+			lobby, err := m.Create("lobby", "alice", "")
+			tt.NoError(err)
+			legacy, err := m.CreateRoom(0)
+			tt.NoError(err)
+			temp, err := m.Create("", "alice", "")
+			tt.NoError(err)
+			tt.Equal(3, temp.Id)
+
+			// 临时房间的最后一个连接离开后释放, 房间名或无创建者的房间保留
+			for _, r := range []*models.Room{lobby, legacy, temp} {
+				_, _, err = r.Entry("c1", "c1", "alice", nil)
+				tt.NoError(err)
+				r.Leave("c1")
+			}
+			for deadline := time.Now().Add(time.Second); m.GetByID(temp.Id) != nil && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			tt.Nil(m.GetByID(temp.Id))
+			tt.Equal(lobby, m.GetByID(lobby.Id))
+			tt.Equal(legacy, m.GetByID(legacy.Id))
+			_, _, err = temp.Entry("c1", "c1", "alice", nil)
+			tt.Equal(errors.ErrRoomIDNotExists, err)
+
+			// 复用模式下释放的房间号再次分配, 否则继续递增
+			r, err := m.Create("", "bob", "")
+			tt.NoError(err)
+			if reuse {
+				tt.Equal(temp.Id, r.Id)
+			} else {
+				tt.Equal(temp.Id+1, r.Id)
+			}
+		})
+	}
+}
+
+func TestManagerRestoreAllocate(t *testing.T) {
+	tt := require.New(t)
+
+	m := rooms.New(nil, false, nil)
+	m.Restore(nil, &store.Data{Rooms: []*store.Room{
+		{ID: 1, Meta: models.RoomMeta{Name: "lobby"}},
+		{ID: 5},
+		{ID: 6, Meta: models.RoomMeta{Creator: "alice"}},
+	}, LastRoomID: 7})
+	tt.Equal(1, m.Lookup("lobby").Id)
+	tt.Nil(m.GetByID(6))
+	_, err := m.Create("LOBBY", "bob", "")
+	tt.Equal(errors.ErrRoomNameExists, err)
+
+	// 已删除的房间号不再分配
+	r, err := m.Create("", "bob", "")
+	tt.NoError(err)
+	tt.Equal(8, r.Id)
+	tt.Equal("bob", r.Meta().Creator)
+}
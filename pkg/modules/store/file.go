@@ -0,0 +1,436 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/models"
+)
+
+// File 基于追加写日志的文件存储, 每行一条JSON记录.
+// 打开时按房间消息保留策略(MaxRoomHistory/RoomHistoryKeepDuration)压缩日志;
+// 运行中日志增长超过StoreCompactSize且达到上次压缩后大小的两倍时由后台协程再次压缩,
+// 避免用户信箱等反复保存的记录使日志无限增长; 压缩期间追加写不受阻塞
+type File struct {
+	path    string
+	file    *os.File
+	size    int64 // size 日志当前大小
+	base    int64 // base 上次压缩后的大小
+	conf    *config.Settings
+	mtx     *sync.Mutex
+	compact chan struct{} // compact 通知后台协程压缩日志, 见compactor
+	closed  chan struct{}
+	wg      *sync.WaitGroup
+}
+
+var _ Store = (*File)(nil)
+
+const (
+	kindUser    = "user"
+	kindRoom    = "room"
+	kindMessage = "message"
+	kindDelete  = "delete" // kindDelete 删除房间; 压缩后保留已使用的最大房间号
+)
+
+// record 日志记录
+type record struct {
+	Kind    string           `json:"kind"`
+	User    *models.User     `json:"user,omitempty"`
+	Room    int              `json:"room,omitempty"`
+	Meta    *models.RoomMeta `json:"meta,omitempty"`
+	LastID  uint64           `json:"lastId,omitempty"` // LastID 压缩时记录房间最后分配的消息ID
+	Message *message         `json:"message,omitempty"`
+}
+
+type message struct {
+	ID       uint64     `json:"id"`
+	Seq      protoc.Seq `json:"seq"`
+	From     string     `json:"from"`
+	Body     string     `json:"body"`
+	Time     int64      `json:"time"` // Time 发布时间(毫秒)
+	Mentions []string   `json:"mentions,omitempty"`
+}
+
+// Open 打开path处的存储, 不存在时创建; conf为nil时使用当前全局配置
+func Open(path string, conf *config.Settings) (*File, error) {
+	if conf == nil {
+		conf = config.Current()
+	}
+	f := &File{
+		path:    path,
+		conf:    conf,
+		mtx:     &sync.Mutex{},
+		compact: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+		wg:      &sync.WaitGroup{},
+	}
+	d, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := f.temp(d)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.replace(tmp); err != nil {
+		return nil, err
+	}
+	if err = f.open(); err != nil {
+		return nil, err
+	}
+	f.wg.Add(1)
+	go f.compactor()
+	return f, nil
+}
+
+// open 打开压缩后的日志用于追加写
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size, f.base = file, info.Size(), info.Size()
+	return nil
+}
+
+func (f *File) Load() (*Data, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.read()
+}
+
+func (f *File) SaveUser(u *models.User) error {
+	return f.append(&record{Kind: kindUser, User: u})
+}
+
+func (f *File) SaveRoom(id int, meta models.RoomMeta) error {
+	return f.append(&record{Kind: kindRoom, Room: id, Meta: &meta})
+}
+
+func (f *File) AppendMessage(room int, msg *protoc.Echo) error {
+	return f.append(messageRecord(room, msg))
+}
+
+func (f *File) DeleteRoom(id int) error {
+	return f.append(&record{Kind: kindDelete, Room: id})
+}
+
+func messageRecord(room int, msg *protoc.Echo) *record {
+	return &record{Kind: kindMessage, Room: room, Message: &message{
+		ID:       msg.MsgID,
+		Seq:      msg.Seq,
+		From:     msg.From,
+		Body:     msg.Body,
+		Time:     msg.Time,
+		Mentions: msg.Mentions,
+	}}
+}
+
+// Close 停止后台压缩并关闭日志, 等待进行中的压缩完成
+func (f *File) Close() error {
+	f.mtx.Lock()
+	select {
+	case <-f.closed:
+		f.mtx.Unlock()
+		return os.ErrClosed
+	default:
+		close(f.closed)
+	}
+	f.mtx.Unlock()
+
+	f.wg.Wait()
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.file.Close()
+}
+
+func (f *File) append(r *record) error {
+	dat, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	n, err := f.file.Write(append(dat, '\n'))
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	f.notify()
+	return nil
+}
+
+// due 日志是否需要压缩; 调用方持有f.mtx
+func (f *File) due() bool {
+	grown := f.size - f.base
+	return f.conf.StoreCompactSize > 0 && grown >= int64(f.conf.StoreCompactSize) && grown >= f.base
+}
+
+// notify 日志需要压缩时通知后台协程, 压缩进行中不重复通知; 调用方持有f.mtx
+func (f *File) notify() {
+	if !f.due() {
+		return
+	}
+	select {
+	case f.compact <- struct{}{}:
+	default:
+	}
+}
+
+// compactor 后台压缩日志, 直到Close
+func (f *File) compactor() {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-f.compact:
+		}
+		if err := f.rewrite(); err != nil {
+			// 记录均已写入, 压缩失败不影响保存, 日志再增长一倍后重试
+			log.Printf("store %s: compact: %v", f.path, err)
+			f.mtx.Lock()
+			f.base = f.size
+			f.mtx.Unlock()
+		}
+	}
+}
+
+// rewrite 运行中压缩日志: 在锁外压缩当前已写入的记录, 再持有f.mtx补写压缩期间追加的记录,
+// 替换日志并重新打开
+func (f *File) rewrite() error {
+	f.mtx.Lock()
+	due, at := f.due(), f.size
+	f.mtx.Unlock()
+	if !due {
+		return nil
+	}
+
+	dat, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	if int64(len(dat)) < at {
+		return fmt.Errorf("store %s: truncated to %d bytes, expect %d", f.path, len(dat), at)
+	}
+	d, err := f.parse(dat[:at])
+	if err != nil {
+		return err
+	}
+	tmp, err := f.temp(d)
+	if err != nil {
+		return err
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	base, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = f.tail(tmp, at)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = f.replace(tmp); err != nil {
+		return err
+	}
+	old := f.file
+	if err = f.open(); err != nil {
+		return err
+	}
+	// 压缩期间追加的记录未经压缩, 仍较多时再次压缩
+	f.base = base
+	f.notify()
+	return old.Close()
+}
+
+// tail 将日志中at之后的记录追加到tmp; 调用方持有f.mtx
+func (f *File) tail(tmp *os.File, at int64) error {
+	src, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err = src.Seek(at, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, src)
+	return err
+}
+
+// read 读取并回放日志
+func (f *File) read() (*Data, error) {
+	dat, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return &Data{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.parse(dat)
+}
+
+// parse 回放日志内容; 最后一行不完整(写入中途退出)时忽略
+func (f *File) parse(dat []byte) (*Data, error) {
+	d := &Data{}
+
+	var (
+		users = make(map[string]int) // users 用户名在d.Users中的下标
+		rooms = make(map[int]*Room)
+		lines = bytes.Split(dat, []byte{'\n'})
+	)
+	room := func(id int) *Room {
+		r, ok := rooms[id]
+		if !ok {
+			r = &Room{ID: id}
+			rooms[id] = r
+			d.Rooms = append(d.Rooms, r)
+		}
+		if id > d.LastRoomID {
+			d.LastRoomID = id
+		}
+		return r
+	}
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		r := &record{}
+		if err := json.Unmarshal(line, r); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("store %s: line %d: %v", f.path, i+1, err)
+		}
+		switch r.Kind {
+		case kindUser:
+			if r.User == nil {
+				continue
+			}
+			if idx, ok := users[r.User.Name]; ok {
+				d.Users[idx] = *r.User
+			} else {
+				users[r.User.Name] = len(d.Users)
+				d.Users = append(d.Users, *r.User)
+			}
+		case kindRoom:
+			rm := room(r.Room)
+			if r.Meta != nil {
+				rm.Meta = *r.Meta
+			}
+			if r.LastID > rm.LastID {
+				rm.LastID = r.LastID
+			}
+		case kindMessage:
+			if r.Message == nil {
+				continue
+			}
+			msg := protoc.NewEcho(r.Message.Seq, r.Message.From, r.Message.Body)
+			msg.SetMeta(r.Message.ID, time.UnixMilli(r.Message.Time))
+			if len(r.Message.Mentions) > 0 {
+				msg.SetMentions(r.Message.Mentions)
+			}
+			rm := room(r.Room)
+			rm.Messages = append(rm.Messages, msg)
+			if msg.MsgID > rm.LastID {
+				rm.LastID = msg.MsgID
+			}
+		case kindDelete:
+			if r.Room > d.LastRoomID {
+				d.LastRoomID = r.Room
+			}
+			if rm, ok := rooms[r.Room]; ok {
+				delete(rooms, r.Room)
+				for i := range d.Rooms {
+					if d.Rooms[i] == rm {
+						d.Rooms = append(d.Rooms[:i], d.Rooms[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+	}
+	return d, nil
+}
+
+// temp 按保留策略丢弃过期消息后将d写入临时文件, 返回未关闭的临时文件, 见replace
+func (f *File) temp(d *Data) (*os.File, error) {
+	file, err := os.Create(f.path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(file)
+	if err = encode(w, d, f.conf); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// replace 同步并关闭临时文件后替换日志
+func (f *File) replace(tmp *os.File) error {
+	defer os.Remove(tmp.Name())
+	err := tmp.Sync()
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func encode(w io.Writer, d *Data, conf *config.Settings) error {
+	enc := json.NewEncoder(w)
+	for i := range d.Users {
+		if err := enc.Encode(&record{Kind: kindUser, User: &d.Users[i]}); err != nil {
+			return err
+		}
+	}
+	last := 0
+	now, keep := time.Now(), conf.RoomHistoryKeepDuration
+	for _, room := range d.Rooms {
+		if room.ID > last {
+			last = room.ID
+		}
+		if err := enc.Encode(&record{Kind: kindRoom, Room: room.ID, Meta: &room.Meta, LastID: room.LastID}); err != nil {
+			return err
+		}
+		list := room.Messages
+		if len(list) > conf.MaxRoomHistory {
+			list = list[len(list)-conf.MaxRoomHistory:]
+		}
+		for _, msg := range list {
+			if keep > 0 && now.Sub(msg.PubAt()) > keep {
+				continue
+			}
+			if err := enc.Encode(messageRecord(room.ID, msg)); err != nil {
+				return err
+			}
+		}
+	}
+	if d.LastRoomID > last {
+		return enc.Encode(&record{Kind: kindDelete, Room: d.LastRoomID})
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package store_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saitofun/chat/cmd/config"
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/saitofun/chat/pkg/modules/store"
+	"github.com/stretchr/testify/require"
+)
+
+func echo(id uint64, body string, at time.Time) *protoc.Echo {
+	msg := protoc.NewEcho(protoc.Seq(id), "alice", body)
+	msg.SetMeta(id, at)
+	return msg
+}
+
+func TestFile(t *testing.T) {
+	tt := require.New(t)
+
+	conf := config.Current()
+	conf.MaxRoomHistory, conf.RoomHistoryKeepDuration = 2, time.Hour
+
+	path := filepath.Join(t.TempDir(), "chat.jsonl")
+	f, err := store.Open(path, conf)
+	tt.NoError(err)
+
+	now := time.Now()
+	tt.NoError(f.SaveUser(&models.User{Name: "alice", CreatedAt: now}))
+	tt.NoError(f.SaveUser(&models.User{Name: "bob", CreatedAt: now}))
+	tt.NoError(f.SaveUser(&models.User{Name: "alice", CreatedAt: now, LastLogin: now}))
+	tt.NoError(f.SaveRoom(1, models.RoomMeta{Name: "lobby", Creator: "alice", CreatedAt: now}))
+	tt.NoError(f.SaveRoom(2, models.RoomMeta{}))
+	tt.NoError(f.SaveRoom(1, models.RoomMeta{Name: "lobby", Topic: "hello", Creator: "alice", CreatedAt: now}))
+	tt.NoError(f.AppendMessage(1, echo(1, "expired", now.Add(-2*time.Hour))))
+	tt.NoError(f.AppendMessage(1, echo(2, "dropped", now)))
+	tt.NoError(f.AppendMessage(1, echo(3, "kept 1", now)))
+	tt.NoError(f.AppendMessage(1, echo(4, "kept 2", now)))
+	tt.NoError(f.AppendMessage(2, echo(1, "expired", now.Add(-2*time.Hour))))
+
+	d, err := f.Load()
+	tt.NoError(err)
+	tt.Len(d.Users, 2)
+	tt.Equal("alice", d.Users[0].Name)
+	tt.True(d.Users[0].LastLogin.Equal(now))
+	tt.Len(d.Rooms, 2)
+	tt.Len(d.Rooms[0].Messages, 4)
+	tt.NoError(f.Close())
+
+	// 写入中途退出留下的不完整记录被忽略, 重新打开时按保留策略压缩
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	tt.NoError(err)
+	_, err = file.WriteString(`{"kind":"message","room":1,"mess`)
+	tt.NoError(err)
+	tt.NoError(file.Close())
+
+	f, err = store.Open(path, conf)
+	tt.NoError(err)
+	defer f.Close()
+	d, err = f.Load()
+	tt.NoError(err)
+	tt.Len(d.Users, 2)
+	tt.Equal([]int{1, 2}, []int{d.Rooms[0].ID, d.Rooms[1].ID})
+	tt.Equal("lobby", d.Rooms[0].Meta.Name)
+	tt.Equal("hello", d.Rooms[0].Meta.Topic)
+	tt.Len(d.Rooms[0].Messages, 2)
+	tt.Equal("kept 1", d.Rooms[0].Messages[0].Body)
+	tt.Equal(uint64(4), d.Rooms[0].LastID)
+	tt.Empty(d.Rooms[1].Messages)
+	tt.Equal(uint64(1), d.Rooms[1].LastID)
+}
+
+func TestFileCompact(t *testing.T) {
+	tt := require.New(t)
+
+	conf := config.Current()
+	conf.StoreCompactSize, conf.MaxRoomHistory = 4096, 10
+
+	path := filepath.Join(t.TempDir(), "chat.jsonl")
+	f, err := store.Open(path, conf)
+	tt.NoError(err)
+	defer f.Close()
+
+	// 反复保存同一用户, 日志由后台协程在运行中压缩, 大小保持有界
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		tt.NoError(f.SaveUser(&models.User{Name: "alice", CreatedAt: now, LastLogin: now.Add(time.Duration(i))}))
+		tt.NoError(f.AppendMessage(1, echo(uint64(i+1), "hello", now)))
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		info, err := os.Stat(path)
+		tt.NoError(err)
+		if info.Size() < int64(4*conf.StoreCompactSize) {
+			break
+		}
+		tt.True(time.Now().Before(deadline), info.Size())
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 压缩后继续追加到新的日志
+	tt.NoError(f.SaveUser(&models.User{Name: "bob", CreatedAt: now}))
+	d, err := f.Load()
+	tt.NoError(err)
+	tt.Len(d.Users, 2)
+	tt.True(d.Users[0].LastLogin.Equal(now.Add(999)))
+	tt.Len(d.Rooms, 1)
+	tt.Equal(uint64(1000), d.Rooms[0].LastID)
+	tt.True(len(d.Rooms[0].Messages) < 1000)
+	tt.Equal(uint64(1000), d.Rooms[0].Messages[len(d.Rooms[0].Messages)-1].MsgID)
+}
+
+func TestFileDeleteRoom(t *testing.T) {
+	tt := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "chat.jsonl")
+	f, err := store.Open(path, nil)
+	tt.NoError(err)
+
+	now := time.Now()
+	tt.NoError(f.SaveRoom(1, models.RoomMeta{Name: "lobby", CreatedAt: now}))
+	tt.NoError(f.SaveRoom(2, models.RoomMeta{Creator: "alice", CreatedAt: now}))
+	tt.NoError(f.AppendMessage(2, echo(1, "hello", now)))
+	tt.NoError(f.DeleteRoom(2))
+
+	d, err := f.Load()
+	tt.NoError(err)
+	tt.Len(d.Rooms, 1)
+	tt.Equal(2, d.LastRoomID)
+
+	// 压缩后删除的房间及消息不再保留, 已使用的最大房间号仍保留
+	tt.NoError(f.Close())
+	f, err = store.Open(path, nil)
+	tt.NoError(err)
+	defer f.Close()
+	d, err = f.Load()
+	tt.NoError(err)
+	tt.Len(d.Rooms, 1)
+	tt.Equal(1, d.Rooms[0].ID)
+	tt.Equal(2, d.LastRoomID)
+
+	// 删除后以同一房间号重新创建
+	tt.NoError(f.SaveRoom(2, models.RoomMeta{Creator: "bob", CreatedAt: now}))
+	d, err = f.Load()
+	tt.NoError(err)
+	tt.Len(d.Rooms, 2)
+	tt.Equal("bob", d.Rooms[1].Meta.Creator)
+	tt.Empty(d.Rooms[1].Messages)
+}
@@ -0,0 +1,37 @@
+package store
+
+import (
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/models"
+)
+
+// Store 用户、房间及房间消息的持久化存储, 启动时由Load恢复, 运行中随变更写入
+type Store interface {
+	// Load 加载已保存的全部数据
+	Load() (*Data, error)
+	// SaveUser 保存用户, 同名用户覆盖
+	SaveUser(u *models.User) error
+	// SaveRoom 保存房间及其元数据, 同一房间覆盖
+	SaveRoom(id int, meta models.RoomMeta) error
+	// AppendMessage 追加房间消息, msg已分配消息ID
+	AppendMessage(room int, msg *protoc.Echo) error
+	// DeleteRoom 删除房间及其消息, 房间号仍计入Data.LastRoomID
+	DeleteRoom(id int) error
+	Close() error
+}
+
+// Data 已保存的数据
+type Data struct {
+	Users []models.User
+	Rooms []*Room // Rooms 按创建顺序
+
+	LastRoomID int // LastRoomID 已使用的最大房间号, 包括已删除的房间
+}
+
+// Room 已保存的房间
+type Room struct {
+	ID       int
+	Meta     models.RoomMeta
+	LastID   uint64         // LastID 最后分配的消息ID, 消息按保留策略清理后仍保留
+	Messages []*protoc.Echo // Messages 按消息ID升序
+}
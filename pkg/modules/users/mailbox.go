@@ -0,0 +1,109 @@
+package users
+
+import (
+	"log"
+
+	"github.com/saitofun/chat/pkg/depends/protoc"
+	"github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/chat/pkg/models"
+)
+
+// Direct 由连接origin发出私信msg, 投递给收件人的全部连接及发件人的其他连接;
+// 收件人不在线时存入其信箱, 登录后由Undelivered取出投递. 返回收件人是否在线
+func (m *Manager) Direct(origin string, msg *protoc.Direct) (bool, error) {
+	m.mtx.Lock()
+	user, ok := m.users[msg.To]
+	if !ok {
+		m.mtx.Unlock()
+		return false, errors.ErrUserNotExisted
+	}
+	recipients := m.devices(msg.To)
+	online := len(recipients) > 0
+	if !online {
+		user.Deposit(models.NewDirectMail(msg), m.conf.MaxMailboxSize)
+		m.save(user)
+	}
+	if msg.To != msg.From {
+		recipients = append(recipients, m.devices(msg.From)...)
+	}
+	m.mtx.Unlock()
+
+	for _, info := range recipients {
+		if info.Node().ID() == origin {
+			continue
+		}
+		if err := info.Direct(msg); err != nil {
+			log.Printf("direct message to %s: %v", info.Node().ID(), err)
+		}
+	}
+	return online, nil
+}
+
+// Undelivered 取出用户信箱中尚未投递的消息, 按存入顺序排列, 取出后视为已投递
+func (m *Manager) Undelivered(name string) []*models.Mail {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	user, ok := m.users[name]
+	if !ok {
+		return nil
+	}
+	ret := user.Undelivered()
+	if len(ret) > 0 {
+		m.save(user)
+	}
+	return ret
+}
+
+// Inbox 用户信箱从序号offset开始的一页, 包括已投递的消息; 用户在线期间信箱不再存入消息, 序号保持不变
+func (m *Manager) Inbox(name string, offset int) *models.Inbox {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var mailbox []*models.Mail
+	if user, ok := m.users[name]; ok {
+		mailbox = user.Mailbox
+	}
+	return models.NewInbox(mailbox, offset, m.conf.MaxFrameSize)
+}
+
+// Mentions 消息中@提及的已注册用户, 按出现顺序
+func (m *Manager) Mentions(body string) []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var ret []string
+	for _, name := range models.ParseMentions(body) {
+		if _, ok := m.users[name]; ok {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// Mention 房间room中的消息msg提及了msg.Mentions中的用户(发送者自身除外), 不在线的用户存入信箱;
+// 返回需要推送提及通知的连接, 即被提及用户不在该房间的连接, 在该房间的连接已收到消息本身
+func (m *Manager) Mention(msg *protoc.Echo, room int) []*models.UserInfo {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var ret []*models.UserInfo
+	for _, name := range msg.Mentions {
+		user, ok := m.users[name]
+		if !ok || name == msg.From {
+			continue
+		}
+		devices := m.devices(name)
+		if len(devices) == 0 {
+			user.Deposit(models.NewMentionMail(msg, name, room), m.conf.MaxMailboxSize)
+			m.save(user)
+			continue
+		}
+		for _, info := range devices {
+			if r := info.Room(); r == nil || r.Id != room {
+				ret = append(ret, info)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,108 @@
+package users
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/saitofun/chat/pkg/errors"
+	"github.com/saitofun/chat/pkg/models"
+	"github.com/saitofun/qlib/net/qsock"
+)
+
+// session 登录会话, 可在任意连接上恢复
+type session struct {
+	id        string // id 会话标识, 见models.Session
+	name      string
+	cid       string // cid 最近绑定的连接
+	expiresAt time.Time
+}
+
+// Resume 以令牌在连接c上恢复会话并续期; 会话绑定的原连接仍在线时(如客户端异常退出尚未检测到断开)
+// 解除原连接的登录并返回原连接, 由调用方通知并断开; 该用户其他设备的登录不受影响
+func (m *Manager) Resume(token string, c *qsock.Node) (*models.UserInfo, *qsock.Node, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	ss, ok := m.sessions[token]
+	if !ok || time.Now().After(ss.expiresAt) {
+		delete(m.sessions, token)
+		return nil, nil, errors.ErrInvalidSession
+	}
+	user, ok := m.users[ss.name]
+	if !ok {
+		delete(m.sessions, token)
+		return nil, nil, errors.ErrInvalidSession
+	}
+	if _, ok = m.clients[c.ID()]; ok {
+		return nil, nil, errors.ErrUserOnline
+	}
+
+	old, ok := m.clients[ss.cid]
+	if ok && (old.Session() == nil || old.Session().Token != token) {
+		old = nil
+	}
+	devices := len(m.devices(user.Name))
+	if old != nil {
+		devices--
+	}
+	if devices >= m.conf.MaxUserDevices {
+		return nil, nil, errors.ErrTooManyDevices
+	}
+
+	// 先登录新连接再解除原连接, 用户的在线时长保持连续
+	ss.cid, ss.expiresAt = c.ID(), time.Now().Add(m.conf.SessionTTL)
+	info := m.attach(user, c)
+	info.SetSession(&models.Session{Token: token, ExpiresAt: ss.expiresAt, ID: ss.id})
+	var replaced *qsock.Node
+	if old != nil {
+		m.detach(old.Node().ID())
+		replaced = old.Node()
+	}
+	m.save(user)
+	return info, replaced, nil
+}
+
+// Logout 注销连接cid上的登录并吊销其会话, all为true时吊销该用户的全部会话; 连接保留, 可重新登录
+func (m *Manager) Logout(cid string, all bool) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	info := m.detach(cid)
+	if info == nil {
+		return errors.ErrUserNotLogin
+	}
+	if all {
+		m.revoke(info.Name, "")
+	} else if ss := info.Session(); ss != nil {
+		delete(m.sessions, ss.Token)
+	}
+	return nil
+}
+
+// issue 为用户签发新会话, 同时清理过期会话; 调用方持有m.mtx
+func (m *Manager) issue(name, cid string) (*models.Session, error) {
+	buf := make([]byte, 40)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for token, ss := range m.sessions {
+		if now.After(ss.expiresAt) {
+			delete(m.sessions, token)
+		}
+	}
+	token := hex.EncodeToString(buf[:32])
+	ss := &session{id: hex.EncodeToString(buf[32:]), name: name, cid: cid, expiresAt: now.Add(m.conf.SessionTTL)}
+	m.sessions[token] = ss
+	return &models.Session{Token: token, ExpiresAt: ss.expiresAt, ID: ss.id}, nil
+}
+
+// revoke 吊销用户除keep外的全部会话; 调用方持有m.mtx
+func (m *Manager) revoke(name, keep string) {
+	for token, ss := range m.sessions {
+		if ss.name == name && token != keep {
+			delete(m.sessions, token)
+		}
+	}
+}
@@ -1,41 +1,68 @@
 package users
 
 import (
+	"log"
 	"sync"
 	"time"
 
+	"github.com/saitofun/chat/cmd/config"
 	"github.com/saitofun/chat/pkg/errors"
 	"github.com/saitofun/chat/pkg/models"
+	"github.com/saitofun/chat/pkg/modules/store"
 	"github.com/saitofun/qlib/net/qsock"
 )
 
-type mgr struct {
-	users   map[string]*models.User
-	clients map[string]*models.UserInfo
-	mtx     *sync.Mutex
+// Manager 用户及在线连接管理
+type Manager struct {
+	users    map[string]*models.User
+	clients  map[string]*models.UserInfo
+	store    store.Store // store 持久化存储, 为nil不持久化
+	fails    map[string]*failure
+	sessions map[string]*session // sessions 令牌到登录会话, 仅保存在内存中
+	conf     *config.Settings
+	mtx      *sync.Mutex
 }
 
-var c = &mgr{
-	users:   make(map[string]*models.User),
-	clients: make(map[string]*models.UserInfo),
-	mtx:     &sync.Mutex{},
+// failure 用户连续登录失败记录
+type failure struct {
+	count    int       // count 连续失败次数, 含正在校验的尝试
+	lockedAt time.Time // lockedAt 锁定时间, 次数已满但仍有尝试在校验中时为零
 }
 
-func Controller() *mgr { return c }
+// New 创建用户管理, conf为nil时使用当前全局配置
+func New(conf *config.Settings) *Manager {
+	if conf == nil {
+		conf = config.Current()
+	}
+	return &Manager{
+		users:    make(map[string]*models.User),
+		clients:  make(map[string]*models.UserInfo),
+		fails:    make(map[string]*failure),
+		sessions: make(map[string]*session),
+		conf:     conf,
+		mtx:      &sync.Mutex{},
+	}
+}
 
-func (m *mgr) GetByName(name string) *models.User {
+func (m *Manager) GetByName(name string) *models.User {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 	return m.users[name]
 }
 
-func (m *mgr) GetByClientID(cid string) *models.UserInfo {
+func (m *Manager) GetByClientID(cid string) *models.UserInfo {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 	return m.clients[cid]
 }
 
-func (m *mgr) CreateUser(name string, c *qsock.Node) (*models.UserInfo, error) {
+// CreateUser 以密码创建用户并登录
+func (m *Manager) CreateUser(name, password string, c *qsock.Node) (*models.UserInfo, error) {
+	hash, err := models.HashPassword(password, m.conf.PasswordCost)
+	if err != nil {
+		return nil, err
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
@@ -45,51 +72,221 @@ func (m *mgr) CreateUser(name string, c *qsock.Node) (*models.UserInfo, error) {
 	if _, ok := m.clients[c.ID()]; ok {
 		return nil, errors.ErrUserOnline
 	}
-	user := &models.User{Name: name, CreatedAt: time.Now()}
-	info := models.NewUserInfo(user, c)
-	m.clients[c.ID()] = info
+	ss, err := m.issue(name, c.ID())
+	if err != nil {
+		return nil, err
+	}
+	user := &models.User{Name: name, CreatedAt: time.Now(), PasswordHash: hash}
 	m.users[name] = user
+	info := m.attach(user, c)
+	info.SetSession(ss)
+	m.save(user)
 	return info, nil
 }
 
-func (m *mgr) UserLogin(name string, c *qsock.Node) (*models.UserInfo, error) {
+// UserLogin 校验密码后在连接c上登录, 同一用户最多同时在MaxUserDevices个连接上登录;
+// 连续失败LoginMaxFailures次后锁定LoginLockout
+func (m *Manager) UserLogin(name, password string, c *qsock.Node) (*models.UserInfo, error) {
+	if err := m.authenticate(name, password); err != nil {
+		return nil, err
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	var (
-		user *models.User
-		info *models.UserInfo
-		ok   bool
-	)
-	if user, ok = m.users[name]; !ok {
+	user, ok := m.users[name]
+	if !ok {
 		return nil, errors.ErrUserNotExisted
 	}
 	if _, ok = m.clients[c.ID()]; ok {
 		return nil, errors.ErrUserOnline
 	}
-	if user.LastLogin.After(user.LogoffAt) {
-		return nil, errors.ErrUserOnline
+	if len(m.devices(name)) >= m.conf.MaxUserDevices {
+		return nil, errors.ErrTooManyDevices
 	}
-	if info, ok = m.clients[c.ID()]; ok {
-		return nil, errors.ErrUserOnline
+	ss, err := m.issue(name, c.ID())
+	if err != nil {
+		return nil, err
 	}
-	info = models.NewUserInfo(user, c)
-	m.clients[c.ID()] = info
+	info := m.attach(user, c)
+	info.SetSession(ss)
+	m.save(user)
 	return info, nil
 }
 
-func (m *mgr) UserOffline(cid string) {
+// ChangePassword 校验旧密码后修改连接cid上登录用户的密码, 修改后吊销该用户其他的会话
+func (m *Manager) ChangePassword(cid, old, password string) error {
+	info := m.GetByClientID(cid)
+	if info == nil {
+		return errors.ErrUserNotLogin
+	}
+	name := info.Name
+	if err := m.authenticate(name, old); err != nil {
+		return err
+	}
+	hash, err := models.HashPassword(password, m.conf.PasswordCost)
+	if err != nil {
+		return err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user, ok := m.users[name]
+	if !ok {
+		return errors.ErrUserNotExisted
+	}
+	user.PasswordHash = hash
+	keep := ""
+	if ss := info.Session(); ss != nil {
+		keep = ss.Token
+	}
+	m.revoke(name, keep)
+	m.save(user)
+	return nil
+}
+
+// SetPassword 管理员重置用户name的密码, 无需旧密码, 用于升级前注册的未设置密码的用户;
+// 重置后吊销该用户全部会话
+func (m *Manager) SetPassword(name, password string) error {
+	hash, err := models.HashPassword(password, m.conf.PasswordCost)
+	if err != nil {
+		return err
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
-	if u, ok := m.clients[cid]; ok {
-		delete(m.clients, cid)
-		if u != nil {
-			u.Logoff()
+	user, ok := m.users[name]
+	if !ok {
+		return errors.ErrUserNotExisted
+	}
+	user.PasswordHash = hash
+	delete(m.fails, name)
+	m.revoke(name, "")
+	m.save(user)
+	return nil
+}
+
+// authenticate 校验用户密码并记录失败次数; 哈希比对耗时较长, 不持有m.mtx
+func (m *Manager) authenticate(name, password string) error {
+	m.mtx.Lock()
+	user, ok := m.users[name]
+	if !ok {
+		m.mtx.Unlock()
+		return errors.ErrUserNotExisted
+	}
+	hash := user.PasswordHash
+	if hash == "" {
+		m.mtx.Unlock()
+		return errors.ErrPasswordNotSet
+	}
+	f, ok := m.fails[name]
+	if !ok {
+		f = &failure{}
+		m.fails[name] = f
+	}
+	if f.count >= m.conf.LoginMaxFailures {
+		if f.lockedAt.IsZero() || time.Since(f.lockedAt) < m.conf.LoginLockout {
+			m.mtx.Unlock()
+			return errors.ErrUserLocked
+		}
+		f.count, f.lockedAt = 0, time.Time{}
+	}
+	// 比对哈希前先占用一次尝试, 并发的登录请求不能越过失败次数上限
+	f.count++
+	m.mtx.Unlock()
+
+	err := models.CheckPassword(hash, password)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if err == nil {
+		// 登录成功, 回滚占用并清除连续失败记录
+		if m.fails[name] == f {
+			delete(m.fails, name)
 		}
+		return nil
 	}
+	if f.count >= m.conf.LoginMaxFailures && f.lockedAt.IsZero() {
+		f.lockedAt = time.Now()
+	}
+	return err
 }
 
-func (m *mgr) GetUserInfoByName(name string) *models.UserInfo {
+// UserOffline 连接cid断开, 用户的最后一个连接断开时记录下线时间
+func (m *Manager) UserOffline(cid string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if u := m.detach(cid); u != nil {
+		u.Node().Stop()
+	}
+}
+
+// Profile 用户信息快照, 在线时长及在线连接数合并该用户的全部连接; 用户不存在返回nil
+func (m *Manager) Profile(name string) *models.UserProfile {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	user, ok := m.users[name]
+	if !ok {
+		return nil
+	}
+	devices := m.devices(name)
+	for _, info := range devices {
+		if p := info.Profile(); p.Room != 0 {
+			p.Devices = len(devices)
+			return p
+		}
+	}
+	p := user.Profile()
+	p.Devices = len(devices)
+	return p
+}
+
+// SessionProfile 连接info携带登录会话的用户信息快照, 在m.mtx内读取登录及下线时间
+func (m *Manager) SessionProfile(info *models.UserInfo) *models.UserProfile {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return info.SessionProfile()
+}
+
+// attach 用户在连接c上登录, 用户由离线变为在线时记录登录时间; 调用方持有m.mtx
+func (m *Manager) attach(user *models.User, c *qsock.Node) *models.UserInfo {
+	if len(m.devices(user.Name)) == 0 {
+		user.LastLogin = time.Now()
+	}
+	info := models.NewUserInfo(user, c)
+	m.clients[c.ID()] = info
+	return info
+}
+
+// detach 解除连接cid上的登录并停止接收房间消息, 用户的最后一个连接下线时记录下线时间并保存;
+// 返回解除的登录, 未登录返回nil; 调用方持有m.mtx
+func (m *Manager) detach(cid string) *models.UserInfo {
+	info, ok := m.clients[cid]
+	if !ok {
+		return nil
+	}
+	delete(m.clients, cid)
+	info.Detach()
+	if len(m.devices(info.Name)) == 0 {
+		info.LogoffAt = time.Now()
+	}
+	m.save(info.User)
+	return info
+}
+
+// devices 用户已登录的连接; 调用方持有m.mtx
+func (m *Manager) devices(name string) []*models.UserInfo {
+	var ret []*models.UserInfo
+	for _, info := range m.clients {
+		if info.Name == name {
+			ret = append(ret, info)
+		}
+	}
+	return ret
+}
+
+func (m *Manager) GetUserInfoByName(name string) *models.UserInfo {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
@@ -100,3 +297,33 @@ func (m *mgr) GetUserInfoByName(name string) *models.UserInfo {
 	}
 	return nil
 }
+
+// Restore 恢复d中保存的用户, 此后用户的变更写入s
+func (m *Manager) Restore(s store.Store, d *store.Data) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.store = s
+	for i := range d.Users {
+		u := d.Users[i]
+		if _, ok := m.users[u.Name]; ok {
+			continue
+		}
+		// 异常退出时未记录下线时间, 视为登录后立即下线
+		if u.LastLogin.After(u.LogoffAt) {
+			u.LogoffAt = u.LastLogin
+		}
+		m.users[u.Name] = &u
+	}
+}
+
+// save 持久化用户, 调用方持有m.mtx
+func (m *Manager) save(u *models.User) {
+	if m.store == nil {
+		return
+	}
+	cp := *u
+	if err := m.store.SaveUser(&cp); err != nil {
+		log.Printf("save user %s: %v", u.Name, err)
+	}
+}